@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"example.com/subscribe/subscribe"
+)
+
+// runBenchmark drives the real worker pool against an in-process echo
+// server, so worker and rate settings can be sized without hammering the
+// API. The server answers every request with a small JSON body after the
+// configured artificial latency; the report shows achieved throughput
+// and latency percentiles for the chosen settings.
+func runBenchmark(cfg IConfig) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("starting echo server: %w", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.BenchmarkLatency > 0 {
+			time.Sleep(cfg.BenchmarkLatency)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"echo":true}`)
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	count := cfg.BenchmarkRequests
+	if count <= 0 {
+		count = 1000
+	}
+	assets := make([]subscribe.Asset, count)
+	for i := range assets {
+		assets[i] = subscribe.Asset{Imei: fmt.Sprintf("%015d", i+1)}
+	}
+
+	client, err := subscribe.New(subscribe.Options{
+		Workers:        cfg.Workers,
+		Adaptive:       cfg.Adaptive,
+		MinWorkers:     cfg.MinWorkers,
+		MaxWorkers:     cfg.MaxWorkers,
+		Spread:         cfg.Spread,
+		RampDuration:   cfg.RampDuration,
+		WorkerStagger:  cfg.WorkerStagger,
+		AttemptHistory: true,
+		KeepInput:      true,
+		Token:          "benchmark",
+		FailedLedger:   filepath.Join(os.TempDir(), "benchmark-failed.txt"),
+		BaseURL:        "http://" + listener.Addr().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var durations []time.Duration
+	var failures int
+	start := time.Now()
+	runErr := client.Run(assets, func(result subscribe.Result) {
+		if result.Err() != nil {
+			failures++
+			return
+		}
+		if attempts := result.Attempts(); len(attempts) > 0 {
+			durations = append(durations, attempts[len(attempts)-1].Duration)
+		}
+	})
+	if runErr != nil {
+		return runErr
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p float64) time.Duration {
+		if len(durations) == 0 {
+			return 0
+		}
+		return durations[int(p*float64(len(durations)-1))]
+	}
+
+	fmt.Printf("benchmark: %d requests in %s (%.0f req/s), %d failed\n",
+		count, elapsed.Round(time.Millisecond), float64(count)/elapsed.Seconds(), failures)
+	fmt.Printf("latency: p50=%s p90=%s p99=%s\n",
+		percentile(0.50).Round(time.Millisecond), percentile(0.90).Round(time.Millisecond), percentile(0.99).Round(time.Millisecond))
+
+	return nil
+}
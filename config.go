@@ -0,0 +1,450 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IStringList is a flag.Value that collects repeated flag occurrences.
+type IStringList []string
+
+func (l *IStringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *IStringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type IConfig struct {
+	Workers           int
+	Files             IStringList
+	OnlyFailed        bool
+	MaxRequests       int
+	ConfirmLarge      bool
+	ProdURLPattern    string
+	Yes               bool
+	EventsFile        string
+	SkipFile          string
+	Retries           int
+	AttemptTimeout    time.Duration
+	AuthScheme        string
+	ClientCert        string
+	ClientKey         string
+	Adaptive          bool
+	MinWorkers        int
+	MaxWorkers        int
+	CaptureHeaders    IStringList
+	Headers           IStringList
+	HeadersFile       string
+	LogSample         int
+	BodyFile          string
+	ContentType       string
+	FollowRedirects   bool
+	TraceTiming       bool
+	FailFast          bool
+	TokenCache        string
+	Explain           bool
+	MaxLineLength     int
+	LedgerLineNumbers bool
+	StallTimeout      time.Duration
+	Webhook           string
+	AttemptHistory    bool
+	CountOnly         bool
+	JsonIndent        bool
+	ResumeOffset      string
+	HashCheck         bool
+	WorkerStagger     time.Duration
+	FailureReport     string
+	Scope             string
+	TokenFields       IStringList
+	Abort4xxRatio     float64
+	Backoff429        time.Duration
+	Backoff5xx        time.Duration
+	ValidateURL       string
+	ResultsFile       string
+	RetryBudget       int
+	WarmConnections   bool
+	DedupeRequests    bool
+	PollInterval      time.Duration
+	PollTimeout       time.Duration
+	SummaryOnFailure  bool
+	Token             string
+	StreamResponse    bool
+	Seed              int64
+	Shuffle           bool
+	TLSSessionCache   int
+	RequireJSON       bool
+	DesiredState      string
+	PriorState        string
+	Benchmark         bool
+	BenchmarkLatency  time.Duration
+	BenchmarkRequests int
+	WaitForReady      time.Duration
+	HealthPath        string
+	Query             IStringList
+	VerifyLength      bool
+	PrintCurl         bool
+	UnsafeCurl        bool
+	HashAlgo          string
+	Verify            string
+	DrainResults      bool
+	PayloadA          string
+	PayloadB          string
+	ABRatio           float64
+	FloatNumbers      bool
+	ErrorBody         string
+	StartAt           string
+	Delay             time.Duration
+	Tui               bool
+	ChunkSize         int
+	ChunkPause        time.Duration
+	AllowFile         string
+	DenyFile          string
+	SignKey           string
+	SignAlgo          string
+	MaxBodyBytes      int64
+	OutputDir         string
+	ResponseFormat    string
+	RampDuration      time.Duration
+	Spread            time.Duration
+	RecordFile        string
+	ReplayFile        string
+	Method            string
+	Paginate          bool
+	CursorField       string
+	PrecheckURL       string
+	PrecheckWhen      string
+	OtelEndpoint      string
+}
+
+// parseConfig resolves options from flags, an optional config file and the
+// positional arguments the README documents. Precedence is flags > config
+// file > env; positionals override everything for backwards compatibility.
+func parseConfig() (IConfig, error) {
+	var cfg IConfig
+
+	configPath := flag.String("config", "", "path to a YAML or JSON config file whose keys mirror the flag names")
+	profile := flag.String("profile", "", "named profile from the config file's profiles section to apply")
+	flag.IntVar(&cfg.Workers, "workers", 0, "number of workers for the WaitGroup")
+	flag.Var(&cfg.Files, "file", "file containing IMEIs separated by newlines; repeatable, accepts globs")
+	flag.BoolVar(&cfg.OnlyFailed, "only-failed", false, "re-run only the IMEIs recorded in the failed ledger")
+	flag.IntVar(&cfg.MaxRequests, "max-requests", 0, "abort when the input holds more than this many IMEIs (0 = no limit)")
+	flag.BoolVar(&cfg.ConfirmLarge, "confirm-large", false, "run anyway when the input exceeds -max-requests")
+	flag.StringVar(&cfg.ProdURLPattern, "prod-url-pattern", "", "regexp marking a base URL as production, requiring confirmation")
+	flag.BoolVar(&cfg.Yes, "yes", false, "skip the production confirmation prompt")
+	flag.StringVar(&cfg.EventsFile, "events-file", "", "file to append NDJSON progress events to (disabled when empty)")
+	flag.StringVar(&cfg.SkipFile, "skip-file", "", "watched file of IMEIs to skip while the run is in flight")
+	flag.IntVar(&cfg.Retries, "retries", 0, "extra attempts per IMEI after a retryable failure")
+	flag.DurationVar(&cfg.AttemptTimeout, "attempt-timeout", 0, "deadline per individual attempt, e.g. 10s (0 = client timeout only)")
+	flag.StringVar(&cfg.AuthScheme, "auth-scheme", "Bearer", "scheme prepended to the token in the Authorization header; empty sends the bare token")
+	flag.StringVar(&cfg.ClientCert, "client-cert", "", "PEM client certificate for endpoints requiring mutual TLS")
+	flag.StringVar(&cfg.ClientKey, "client-key", "", "PEM private key belonging to -client-cert")
+	flag.BoolVar(&cfg.Adaptive, "adaptive", false, "ramp worker count automatically instead of using a fixed pool")
+	flag.IntVar(&cfg.MinWorkers, "min-workers", 1, "lower bound for -adaptive")
+	flag.IntVar(&cfg.MaxWorkers, "max-workers", 32, "upper bound for -adaptive")
+	flag.Var(&cfg.CaptureHeaders, "capture-header", "response header to record into the result; repeatable")
+	flag.Var(&cfg.Headers, "header", "static request header as \"Name: Value\"; repeatable")
+	flag.StringVar(&cfg.HeadersFile, "headers-file", "", "file of \"Name: Value\" lines added to every request")
+	flag.IntVar(&cfg.LogSample, "log-sample", 0, "print only every Nth successful result to keep the terminal readable; failures always log (0 = print all)")
+	flag.StringVar(&cfg.BodyFile, "body-file", "", "file whose contents are sent verbatim as the request body, bypassing JSON marshaling")
+	flag.StringVar(&cfg.ContentType, "content-type", "", "Content-Type sent with the request body (default application/json)")
+	flag.BoolVar(&cfg.FollowRedirects, "follow-redirects", true, "follow 3xx redirects; disable to treat a redirect as a failure")
+	flag.BoolVar(&cfg.TraceTiming, "trace-timing", false, "log the DNS/connect/TLS/TTFB breakdown for every attempt")
+	flag.BoolVar(&cfg.FailFast, "fail-fast", false, "abort the whole run on the first failed request")
+	flag.StringVar(&cfg.TokenCache, "token-cache", "", "file to persist the access token in between runs (written 0600)")
+	flag.BoolVar(&cfg.Explain, "explain", false, "print the fully resolved configuration and exit without doing work")
+	flag.IntVar(&cfg.MaxLineLength, "max-line-length", 0, "largest input line in bytes before the reader errors (0 = scanner default)")
+	flag.BoolVar(&cfg.LedgerLineNumbers, "ledger-line-numbers", false, "append the source line number to failed ledger entries")
+	flag.DurationVar(&cfg.StallTimeout, "stall-timeout", 0, "abort the run when no result arrives for this long (0 = no watchdog)")
+	flag.StringVar(&cfg.Webhook, "webhook", "", "URL to POST a JSON event per result to (disabled when empty)")
+	flag.BoolVar(&cfg.AttemptHistory, "attempt-history", false, "attach the reason/duration of every attempt to each result")
+	flag.BoolVar(&cfg.CountOnly, "count-only", false, "print how many IMEIs the input would produce, with a breakdown, and exit")
+	flag.BoolVar(&cfg.JsonIndent, "json-indent", false, "print response bodies as indented JSON for human inspection")
+	flag.StringVar(&cfg.ResumeOffset, "resume-offset", "", "checkpoint file holding the input byte offset to resume from; the source file is not rewritten")
+	flag.BoolVar(&cfg.HashCheck, "hash-check", false, "with -resume-offset, abort when the already-consumed part of the input changed between runs")
+	flag.DurationVar(&cfg.WorkerStagger, "worker-stagger", 0, "delay between launching workers, smoothing the connection burst at startup")
+	flag.StringVar(&cfg.FailureReport, "failure-report", "", "file to write a JSON report grouping failures by reason (disabled when empty)")
+	flag.StringVar(&cfg.Scope, "scope", "", "OAuth scope sent with the token request (default AUTH_SCOPE from the env)")
+	flag.Var(&cfg.TokenFields, "token-field", "token response field mapping as canonical=actual, e.g. access_token=accessToken; repeatable")
+	flag.Float64Var(&cfg.Abort4xxRatio, "abort-4xx-ratio", 0, "abort once this fraction of recent responses is a 4xx (0 = disabled)")
+	flag.DurationVar(&cfg.Backoff429, "backoff-429", time.Second, "base delay between retries after a 429, doubled per attempt; Retry-After wins")
+	flag.DurationVar(&cfg.Backoff5xx, "backoff-5xx", 250*time.Millisecond, "base delay between retries after a 5xx, doubled per attempt")
+	flag.StringVar(&cfg.ValidateURL, "validate-url", "", "endpoint the payload is OPTIONS-validated against before the run starts")
+	flag.StringVar(&cfg.ResultsFile, "results-file", "", "file to append one JSON line per result to (disabled when empty)")
+	flag.IntVar(&cfg.RetryBudget, "retry-budget", 0, "total retries the whole run may spend before failing fast (0 = unlimited)")
+	flag.BoolVar(&cfg.WarmConnections, "warm-connections", false, "establish one connection per host before dispatching, keeping TLS handshakes out of the first requests' latency")
+	flag.BoolVar(&cfg.DedupeRequests, "dedupe-requests", false, "skip a request when an identical url+body was already sent in this run")
+	flag.DurationVar(&cfg.PollInterval, "poll-interval", 2*time.Second, "initial delay between polls of a 202 Location, doubled per poll")
+	flag.DurationVar(&cfg.PollTimeout, "poll-timeout", 0, "how long to poll a 202 Location for a terminal response (0 = treat 202 as a failure)")
+	flag.BoolVar(&cfg.SummaryOnFailure, "summary-only-on-failure", false, "print nothing on a clean run; on failures, replay the suppressed output and the summary")
+	flag.StringVar(&cfg.Token, "token", "", "pre-issued access token used verbatim, skipping the oauth request; @path reads a file, - reads stdin")
+	flag.BoolVar(&cfg.StreamResponse, "stream-response", false, "decode the response as a stream of JSON objects instead of one object; shorthand for -response-format ndjson")
+	flag.Int64Var(&cfg.Seed, "seed", 0, "seed for every randomized feature (jitter, shuffling), making a run replayable (0 = derive from the clock)")
+	flag.BoolVar(&cfg.Shuffle, "shuffle", false, "dispatch the input in random order instead of file order, spreading load across server shards")
+	flag.IntVar(&cfg.TLSSessionCache, "tls-session-cache", 64, "sessions kept for TLS resumption, making repeated connections skip the full handshake (0 = disabled)")
+	flag.BoolVar(&cfg.RequireJSON, "require-json-response", false, "fail a 200 whose Content-Type is not JSON, naming the type instead of a confusing decode error")
+	flag.StringVar(&cfg.DesiredState, "desired-state", "", "JSON file mapping IMEI to desired field values; each request body holds only the fields differing from -prior-state (combine with -method PATCH)")
+	flag.StringVar(&cfg.PriorState, "prior-state", "", "JSON file with the previously applied state -desired-state is diffed against")
+	flag.BoolVar(&cfg.Benchmark, "benchmark", false, "run against a built-in echo server and report throughput and latency percentiles, without touching the API")
+	flag.DurationVar(&cfg.BenchmarkLatency, "benchmark-latency", 20*time.Millisecond, "artificial latency the echo server adds per request")
+	flag.IntVar(&cfg.BenchmarkRequests, "benchmark-requests", 1000, "number of synthetic requests the benchmark dispatches")
+	flag.DurationVar(&cfg.WaitForReady, "wait-for-ready", 0, "poll the health endpoint with backoff for up to this long before starting (0 = start immediately)")
+	flag.StringVar(&cfg.HealthPath, "health-path", "/health", "path under the base URL that -wait-for-ready polls")
+	flag.Var(&cfg.Query, "query", "query parameter as key=value appended to the subscribe URL; repeatable")
+	flag.BoolVar(&cfg.VerifyLength, "verify-content-length", false, "fail a response whose body is shorter or longer than its Content-Length header claims")
+	flag.BoolVar(&cfg.PrintCurl, "print-curl", false, "log an equivalent curl command for every request, with the Authorization header redacted")
+	flag.BoolVar(&cfg.UnsafeCurl, "unsafe-print-curl", false, "include the real Authorization header in -print-curl output")
+	flag.StringVar(&cfg.HashAlgo, "hash", "fnv", "digest behind run-scoped features like -dedupe-requests: fnv (fast) or sha256 (stable across versions)")
+	flag.StringVar(&cfg.Verify, "verify", "", "after the run, GET every written IMEI and require this dotted.path=value to hold, catching 200s that did not persist (disabled when empty)")
+	flag.BoolVar(&cfg.DrainResults, "drain-results", false, "drain response bodies without decoding and skip per-result printing; only the side effects and the summary matter")
+	flag.StringVar(&cfg.PayloadA, "payload-a", "", "body file for variant A of an A/B run; requires -payload-b")
+	flag.StringVar(&cfg.PayloadB, "payload-b", "", "body file for variant B of an A/B run; requires -payload-a")
+	flag.Float64Var(&cfg.ABRatio, "ab-ratio", 0.5, "fraction of IMEIs assigned to -payload-a; assignment draws from the seeded source")
+	flag.BoolVar(&cfg.FloatNumbers, "float-numbers", false, "decode JSON numbers as float64 instead of exact literals, restoring the old behavior at the cost of 64-bit id precision")
+	flag.StringVar(&cfg.ErrorBody, "error-body", "", "statuses whose response body is captured in error output, as a comma list of codes or classes, e.g. 5xx,429 (empty = all)")
+	flag.StringVar(&cfg.StartAt, "start-at", "", "local time (2006-01-02T15:04:05) to begin the run, e.g. an off-peak window")
+	flag.DurationVar(&cfg.Delay, "delay", 0, "wait this long before beginning the run; -start-at wins when both are set")
+	flag.BoolVar(&cfg.Tui, "tui", false, "redraw a live status block (counts, rate, recent failures, hosts) instead of scrolling per-result output; needs a TTY")
+	flag.IntVar(&cfg.ChunkSize, "chunk-size", 0, "process the input in chunks of this many IMEIs, with a per-chunk summary (0 = one chunk)")
+	flag.DurationVar(&cfg.ChunkPause, "chunk-pause", 0, "pause between chunks, giving the API breathing room during scheduled windows")
+	flag.StringVar(&cfg.AllowFile, "allow", "", "file of IMEIs; when set, only these are processed")
+	flag.StringVar(&cfg.DenyFile, "deny", "", "file of IMEIs to skip")
+	flag.StringVar(&cfg.SignKey, "sign-key", "", "HMAC key for signing requests (disabled when empty)")
+	flag.StringVar(&cfg.SignAlgo, "sign-algo", "sha256", "HMAC algorithm for -sign-key: sha1 or sha256")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", 0, "refuse to send request bodies larger than this many bytes (0 = no limit)")
+	flag.StringVar(&cfg.OutputDir, "output-dir", "", "directory receiving a timestamped subdirectory with this run's artifacts")
+	flag.StringVar(&cfg.ResponseFormat, "response-format", "json", "how to decode response bodies: json, xml, text or none")
+	flag.DurationVar(&cfg.RampDuration, "ramp-duration", 0, "spread dispatches out over this warm-up window so the server can scale up")
+	flag.DurationVar(&cfg.Spread, "spread", 0, "random delay up to this duration before each request, smoothing bursty arrival")
+	flag.StringVar(&cfg.RecordFile, "record", "", "cassette file to save request/response pairs to")
+	flag.StringVar(&cfg.ReplayFile, "replay", "", "cassette file to serve responses from instead of the network")
+	flag.StringVar(&cfg.Method, "method", "POST", "HTTP method for the per-IMEI request; GET sends no body")
+	flag.BoolVar(&cfg.Paginate, "paginate", false, "follow cursor pagination on GET responses and aggregate the pages")
+	flag.StringVar(&cfg.CursorField, "cursor-field", "next", "response field holding the next-page cursor for -paginate")
+	flag.StringVar(&cfg.PrecheckURL, "precheck-url", "", "per-IMEI GET URL template (%s = IMEI) checked before subscribing")
+	flag.StringVar(&cfg.PrecheckWhen, "precheck-skip-when", "", "dotted.path=value condition on the precheck response that skips the subscribe")
+	flag.StringVar(&cfg.OtelEndpoint, "otel-endpoint", "", "OTLP/HTTP endpoint to export traces to (disabled when empty)")
+	flag.Parse()
+
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath, *profile); err != nil {
+			return cfg, err
+		}
+	} else if *profile != "" {
+		return cfg, fmt.Errorf("-profile requires -config")
+	}
+
+	expandFlagVars()
+
+	args := flag.Args()
+	if len(args) == 2 {
+		workers, err := strconv.Atoi(args[0])
+		if err != nil {
+			return cfg, fmt.Errorf("parsing worker count: %w", err)
+		}
+		cfg.Workers = workers
+		cfg.Files = IStringList{args[1]}
+	}
+
+	if cfg.Workers < 1 && !cfg.Adaptive {
+		return cfg, fmt.Errorf("provide a worker count, e.g. -workers 8")
+	}
+	if cfg.OnlyFailed && len(cfg.Files) == 0 {
+		cfg.Files = IStringList{failedLedgerPath}
+	}
+	if len(cfg.Files) == 0 && !cfg.Benchmark {
+		return cfg, fmt.Errorf("provide a source file, e.g. -file sourcefile.txt")
+	}
+
+	var files IStringList
+	for _, pattern := range cfg.Files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("bad file glob %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			files = append(files, pattern)
+			continue
+		}
+		files = append(files, matches...)
+	}
+	cfg.Files = files
+
+	return cfg, nil
+}
+
+// loadHeaders merges -headers-file lines with any -header flags into one
+// header set; flags win over the file. Blank lines and #-comments are
+// skipped, anything else must look like "Name: Value".
+func loadHeaders(cfg IConfig) (map[string]string, error) {
+	headers := map[string]string{}
+
+	var lines []string
+	if cfg.HeadersFile != "" {
+		raw, err := os.ReadFile(cfg.HeadersFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading headers file: %w", err)
+		}
+		lines = strings.Split(string(raw), "\n")
+	}
+
+	for _, line := range append(lines, cfg.Headers...) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("bad header line %q, expected \"Name: Value\"", line)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+var varPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// redactedFlags hold secrets that -explain must not echo back.
+var redactedFlags = map[string]bool{"sign-key": true, "token": true}
+
+// explainConfig prints every flag's resolved value, after config file
+// merging and env expansion, so precedence surprises are easy to debug.
+func explainConfig() {
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if value != "" && redactedFlags[f.Name] {
+			value = "<redacted>"
+		}
+		fmt.Printf("%-20s %s\n", f.Name, value)
+	})
+}
+
+// applyProfile overlays the selected profile's values onto the top-level
+// config. A profile's env map seeds environment variables (for the base
+// URL and auth secrets) without overriding what is already set.
+func applyProfile(values map[string]interface{}, profile string) error {
+	profiles, _ := values["profiles"].(map[string]interface{})
+	delete(values, "profiles")
+
+	if profile == "" {
+		return nil
+	}
+	if len(profiles) == 0 {
+		return fmt.Errorf("config file has no profiles section")
+	}
+
+	selected, ok := profiles[profile].(map[string]interface{})
+	if !ok {
+		var names []string
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown profile %q, available: %s", profile, strings.Join(names, ", "))
+	}
+
+	if env, ok := selected["env"].(map[string]interface{}); ok {
+		for name, value := range env {
+			if _, set := os.LookupEnv(name); !set {
+				os.Setenv(name, fmt.Sprintf("%v", value))
+			}
+		}
+		delete(selected, "env")
+	}
+
+	for key, value := range selected {
+		values[key] = value
+	}
+
+	return nil
+}
+
+// expandVars substitutes ${VAR} references with the environment variable's
+// value; unset variables expand to the empty string.
+func expandVars(value string) string {
+	return varPattern.ReplaceAllStringFunc(value, func(match string) string {
+		return os.Getenv(match[2 : len(match)-1])
+	})
+}
+
+// expandFlagVars expands ${VAR} in every string flag value after parsing,
+// so config files and scripts stay reusable across environments.
+func expandFlagVars() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if list, ok := f.Value.(*IStringList); ok {
+			for i, value := range *list {
+				(*list)[i] = expandVars(value)
+			}
+			return
+		}
+		value := f.Value.String()
+		if expanded := expandVars(value); expanded != value {
+			flag.Set(f.Name, expanded)
+		}
+	})
+}
+
+// applyConfigFile feeds the file's values through flag.Set so every flag
+// automatically has a matching config key. Flags given on the command line
+// keep their value, and unknown keys are reported instead of ignored.
+func applyConfigFile(path, profile string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+
+	if err := applyProfile(values, profile); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var unknown []string
+	for key, value := range values {
+		if key == "config" || flag.Lookup(key) == nil {
+			unknown = append(unknown, key)
+			continue
+		}
+		if explicit[key] {
+			continue
+		}
+		if list, ok := value.([]interface{}); ok {
+			for _, item := range list {
+				if err := flag.Set(key, fmt.Sprintf("%v", item)); err != nil {
+					return fmt.Errorf("config key %q: %w", key, err)
+				}
+			}
+			continue
+		}
+		if err := flag.Set(key, fmt.Sprintf("%v", value)); err != nil {
+			return fmt.Errorf("config key %q: %w", key, err)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
@@ -3,3 +3,5 @@ module example.com/subscribe
 go 1.18
 
 require github.com/joho/godotenv v1.4.0
+
+require gopkg.in/yaml.v3 v3.0.1
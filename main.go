@@ -1,316 +1,805 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
+	"math/rand"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"example.com/subscribe/subscribe"
 	"github.com/joho/godotenv"
 )
 
-func getSecrets() (ISubscribeRequest, IGetTokenRequest) {
+type ISubscribeRequest struct {
+	BaseURL string                      `json:"base_url"`
+	Payload subscribe.ISubscribePayload `json:"payload"`
+}
+
+func getSecrets() (ISubscribeRequest, subscribe.IGetTokenRequest, error) {
 	err := godotenv.Load("local.env")
 	if err != nil {
-		log.Fatalf("cannot read env var %s", err)
+		return ISubscribeRequest{}, subscribe.IGetTokenRequest{}, fmt.Errorf("cannot read env var %s", err)
 	}
 
 	return ISubscribeRequest{
 			BaseURL: os.Getenv("SUB_BASE_URL"),
-			Payload: ISubscribePayload{
+			Payload: subscribe.ISubscribePayload{
 				Offer:               os.Getenv("SUB_OFFER"),
 				Account:             os.Getenv("SUB_ACCOUNT"),
 				RebootAfterNextTrip: false,
 			},
-		}, IGetTokenRequest{
+		}, subscribe.IGetTokenRequest{
 			BaseURL:   os.Getenv("AUTH_BASE_URL"),
 			GrantType: os.Getenv("AUTH_GRANT_TYPE"),
 			Username:  os.Getenv("AUTH_USERNAME"),
 			Password:  os.Getenv("AUTH_PASSWORD"),
-		}
+			Scope:     os.Getenv("AUTH_SCOPE"),
+		}, nil
 }
 
-type IResult map[string]interface{}
+var (
+	// runDir holds the per-run artifact directory when -output-dir is
+	// set; artifact paths below are rewritten to live inside it.
+	runDir           = "."
+	failedLedgerPath = "./failed.txt"
+)
 
-type IWorkerResult interface {
-	Err() error
-	Value() IResult
-}
+// initOutputDir creates a timestamped subdirectory under -output-dir so
+// consecutive runs don't overwrite each other's artifacts.
+func initOutputDir(cfg IConfig) error {
+	if cfg.OutputDir == "" {
+		return nil
+	}
 
-type ITokenResponse struct {
-	AccessToken  string `json:"access_token"`
-	TokenType    string `json:"token_type"`
-	ExpiresIn    int    `json:"expires_in"`
-	RefreshToken string `json:"refresh_token"`
-	Scope        string `json:"scope"`
-	CreatedAt    int    `json:"created_at"`
-}
+	dir := filepath.Join(cfg.OutputDir, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
 
-type ISubscribeRequest struct {
-	BaseURL string            `json:"base_url"`
-	Payload ISubscribePayload `json:"payload"`
-}
+	runDir = dir
+	failedLedgerPath = filepath.Join(dir, "failed.txt")
 
-type ISubscribePayload struct {
-	Offer               string `json:"offer"`
-	Account             string `json:"account"`
-	RebootAfterNextTrip bool   `json:"reboot_after_next_trip"`
+	return nil
 }
 
-type IGetTokenRequest struct {
-	BaseURL   string `json:"base_url"`
-	GrantType string `json:"grant_type"`
-	Username  string `json:"username"`
-	Password  string `json:"password"`
+// inRunDir relocates a per-run artifact into the timestamped run
+// directory, leaving absolute paths and the default CWD layout alone.
+func inRunDir(path string) string {
+	if path == "" || runDir == "." || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(runDir, path)
 }
 
-type IWorkerParams struct {
-	Url     string
-	Method  string
-	Imei    string
-	Payload ISubscribePayload
-	Token   string
-	Path    string
-}
+// confirmProduction asks for a typed confirmation before dispatching
+// against a base URL matching -prod-url-pattern. Without a TTY the run
+// aborts unless -yes was passed.
+func confirmProduction(cfg IConfig, baseURL string) bool {
+	if cfg.ProdURLPattern == "" {
+		return true
+	}
 
-type IJsonResult struct {
-	err   error
-	value IResult
-}
+	matched, err := regexp.MatchString(cfg.ProdURLPattern, baseURL)
+	if err != nil {
+		fmt.Printf("bad -prod-url-pattern: %s\n", err)
+		return false
+	}
+	if !matched || cfg.Yes {
+		return true
+	}
 
-func (r IJsonResult) Err() error {
-	return r.err
-}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Println("refusing to run against a production URL without -yes in a non-interactive session")
+		return false
+	}
 
-func (r IJsonResult) Value() IResult {
-	return r.value
-}
+	fmt.Printf("%s matches the production pattern. Type yes to continue: ", baseURL)
+	var answer string
+	fmt.Scanln(&answer)
+	if answer != "yes" {
+		fmt.Println("aborted")
+		return false
+	}
 
-func getToken(cred IGetTokenRequest) (string, error) {
+	return true
+}
 
-	payload, err := json.Marshal(cred)
+const (
+	colorRed    = 31
+	colorGreen  = 32
+	colorYellow = 33
+)
 
-	if err != nil {
-		fmt.Println(err)
-		return "", err
+// colorsEnabled reports whether stdout is a TTY with NO_COLOR unset, the
+// two signals that say ANSI colors are welcome. File and JSON output
+// stays uncolored.
+func colorsEnabled() bool {
+	if _, set := os.LookupEnv("NO_COLOR"); set {
+		return false
 	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/oauth/token", cred.BaseURL), strings.NewReader(string(payload)))
+func paint(enabled bool, color int, message string) string {
+	if !enabled {
+		return message
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, message)
+}
 
+// hashPrefix hashes the first n bytes of the file, i.e. the part an
+// offset resume considers already consumed.
+func hashPrefix(path string, n int64) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
+	defer file.Close()
 
-	req.Header.Add("Content-Type", "application/json")
-
-	res, err := client.Do(req)
-
-	if err != nil {
-		fmt.Println(err)
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, file, n); err != nil && err != io.EOF {
 		return "", err
 	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
 
-	decoder := json.NewDecoder(res.Body)
-
-	defer res.Body.Close()
+// verifyInputHash compares the consumed prefix against the hash recorded
+// by the previous run, catching an input file that was edited in between.
+func verifyInputHash(input, checkpoint string, offset int64) error {
+	saved, err := os.ReadFile(checkpoint + ".sha256")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	var t ITokenResponse
-	if err = decoder.Decode(&t); err != nil {
-		return "", err
+	sum, err := hashPrefix(input, offset)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(saved)) != sum {
+		return fmt.Errorf("%s changed since the last run (hash mismatch); delete %s.sha256 to resume anyway", input, checkpoint)
 	}
+	return nil
+}
 
-	return t.AccessToken, nil
+// readOffset loads the saved byte offset; a missing or unreadable
+// checkpoint simply means starting from the top of the file.
+func readOffset(path string) int64 {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		log.Printf("ignoring bad offset checkpoint %s: %s", path, err)
+		return 0
+	}
+	return offset
 }
 
-func readFile(path string) ([]string, error) {
-	file, err := os.Open(path)
+// ICheckpoint tracks which input lines completed and persists the byte
+// offset of the contiguously completed prefix, so an interrupted run —
+// the primary resume scenario, during which the input file is never
+// rewritten — picks up where it actually stopped. On a clean finish the
+// offset points past the whole window; failed IMEIs are then re-run from
+// the failed ledger, not by replaying the input.
+type ICheckpoint struct {
+	path   string
+	input  string
+	hashed bool
+	base   int64
+	ends   []int64
+
+	mu       sync.Mutex
+	done     []bool
+	complete int   // lines 1..complete have all completed
+	written  int64 // last offset persisted, to skip no-op writes
+}
 
-	if err != nil {
-		return nil, err
+func newCheckpoint(cfg IConfig, base int64, ends []int64) *ICheckpoint {
+	return &ICheckpoint{
+		path:    cfg.ResumeOffset,
+		input:   cfg.Files[0],
+		hashed:  cfg.HashCheck,
+		base:    base,
+		ends:    ends,
+		done:    make([]bool, len(ends)),
+		written: -1,
 	}
+}
 
-	defer file.Close()
+// Done marks one 1-based input line as completed.
+func (c *ICheckpoint) Done(lineNo int) {
+	if c == nil || lineNo < 1 || lineNo > len(c.done) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[lineNo-1] = true
+	for c.complete < len(c.done) && c.done[c.complete] {
+		c.complete++
+	}
+}
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
+// Write persists the offset just past the completed prefix, plus the
+// matching input hash when -hash-check is on. An unchanged offset is not
+// rewritten.
+func (c *ICheckpoint) Write() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	offset := c.base
+	if c.complete > 0 {
+		offset = c.ends[c.complete-1]
+	}
+	if offset == c.written {
+		return nil
 	}
 
-	return lines, scanner.Err()
+	if err := os.WriteFile(c.path, []byte(fmt.Sprintf("%d\n", offset)), 0644); err != nil {
+		return fmt.Errorf("writing offset checkpoint: %w", err)
+	}
+	if c.hashed {
+		sum, err := hashPrefix(c.input, offset)
+		if err != nil {
+			return fmt.Errorf("hashing consumed input: %w", err)
+		}
+		if err := os.WriteFile(c.path+".sha256", []byte(sum+"\n"), 0644); err != nil {
+			return fmt.Errorf("writing input hash: %w", err)
+		}
+	}
+	c.written = offset
+	return nil
 }
 
-func appendToFile(path, content string) {
-	file, err := os.OpenFile(path,
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Println(err)
+// Finish marks the whole window consumed and writes the final offset.
+func (c *ICheckpoint) Finish() error {
+	if c == nil {
+		return nil
 	}
-	defer file.Close()
-	if _, err := file.WriteString(fmt.Sprintf("%s\n", content)); err != nil {
-		log.Println(err)
+	c.mu.Lock()
+	c.complete = len(c.done)
+	c.mu.Unlock()
+	return c.Write()
+}
+
+// main delegates to run so every exit path, including early failures,
+// ends in one consistent status line and exit code for scripts to key on.
+func main() {
+	if err := run(); err != nil {
+		fmt.Printf("Failed: %s\n", err)
+		os.Exit(1)
 	}
 }
 
-func removeLine(path, content string) error {
-	f, err := os.Open(path)
+func run() error {
+
+	cfg, err := parseConfig()
 	if err != nil {
+		fmt.Println("Example ./binaryname 12 ./sourcefile.txt")
 		return err
 	}
 
-	tmpName := fmt.Sprintf("%s~tmp", path)
-	out, err := os.Create(tmpName)
-	if err != nil {
-		return err
+	if cfg.Explain {
+		explainConfig()
+		return nil
 	}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if line := scanner.Text(); line != content {
-			out.WriteString(fmt.Sprintf("%s\n", line))
-		}
+	if cfg.Benchmark {
+		return runBenchmark(cfg)
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := initOutputDir(cfg); err != nil {
 		return err
 	}
 
-	f.Close()
-	out.Close()
-	err = os.Rename(tmpName, path)
+	// Relative artifact paths follow failed.txt into the run directory,
+	// so one -output-dir really collects everything the run produced.
+	cfg.ResultsFile = inRunDir(cfg.ResultsFile)
+	cfg.EventsFile = inRunDir(cfg.EventsFile)
+	cfg.FailureReport = inRunDir(cfg.FailureReport)
+
+	// All randomized behavior draws from the shared math/rand source, so
+	// one seed makes the whole run replayable. Log it even when derived,
+	// so a failing run can be reproduced afterwards.
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rand.Seed(seed)
+	log.Printf("random seed %d", seed)
 
-	return err
-}
+	if cfg.MaxLineLength > 0 {
+		subscribe.MaxLineLength = cfg.MaxLineLength
+	}
+
+	var assets []subscribe.Asset
+	var checkpoint *ICheckpoint
 
-func doWork(client *http.Client, work <-chan IWorkerParams, results chan<- IWorkerResult, wg *sync.WaitGroup) {
-	for params := range work {
-		result, err := doRequest(client, params)
+	if cfg.HashCheck && cfg.ResumeOffset == "" {
+		return fmt.Errorf("-hash-check requires -resume-offset")
+	}
+
+	if cfg.ResumeOffset != "" {
+		if len(cfg.Files) != 1 {
+			return fmt.Errorf("-resume-offset works with exactly one input file")
+		}
+		offset := readOffset(cfg.ResumeOffset)
+		if cfg.HashCheck && offset > 0 {
+			if err := verifyInputHash(cfg.Files[0], cfg.ResumeOffset, offset); err != nil {
+				return err
+			}
+		}
+		lines, ends, err := subscribe.ReadLinesAt(cfg.Files[0], offset)
 		if err != nil {
-			results <- IJsonResult{err: err}
-			continue
+			return err
+		}
+		checkpoint = newCheckpoint(cfg, offset, ends)
+		for _, asset := range subscribe.ParseAssets(lines) {
+			asset.Source = cfg.Files[0]
+			assets = append(assets, asset)
 		}
+	} else if assets, err = subscribe.LoadAssets(cfg.Files, cfg.OnlyFailed, failedLedgerPath); err != nil {
+		return err
+	}
 
-		results <- IJsonResult{value: result}
+	// An empty input is not an error, but say so instead of spinning up
+	// workers and printing a summary about nothing.
+	if len(assets) == 0 {
+		fmt.Println("no IMEIs to process")
+		return nil
 	}
-	wg.Done()
-}
 
-func doRequest(client *http.Client, params IWorkerParams) (IResult, error) {
-	payload, err := json.Marshal(params.Payload)
-	if err != nil {
-		return nil, fmt.Errorf("encoding payload to json: %w", err)
+	if cfg.CountOnly {
+		counts, err := subscribe.Count(assets, cfg.AllowFile, cfg.DenyFile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d IMEIs would be processed (%d invalid, %d duplicates, %d filtered out of %d lines)\n",
+			counts.Valid, counts.Invalid, counts.Duplicates, counts.Filtered, len(assets))
+		return nil
 	}
 
-	req, err := http.NewRequest(params.Method, params.Url, bytes.NewReader(payload))
+	// Safety valve against accidentally running against a huge file.
+	if cfg.MaxRequests > 0 && len(assets) > cfg.MaxRequests && !cfg.ConfirmLarge {
+		return fmt.Errorf("input holds %d IMEIs, more than -max-requests %d; pass -confirm-large to run anyway", len(assets), cfg.MaxRequests)
+	}
+
+	// Inputs are often sorted by region, which concentrates file order on
+	// one shard. Shuffling draws from the seeded source, so -seed replays
+	// the same order; priority still wins inside Run.
+	if cfg.Shuffle {
+		rand.Shuffle(len(assets), func(i, j int) {
+			assets[i], assets[j] = assets[j], assets[i]
+		})
+	}
+
+	headers, err := loadHeaders(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("creating new request: %w", err)
+		return err
+	}
+
+	var rawBody []byte
+	if cfg.BodyFile != "" {
+		if rawBody, err = os.ReadFile(cfg.BodyFile); err != nil {
+			return err
+		}
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", params.Token))
-	req.Header.Add("Content-Type", "application/json")
 
-	res, err := client.Do(req)
+	var bodyA, bodyB []byte
+	if cfg.PayloadA != "" || cfg.PayloadB != "" {
+		if cfg.PayloadA == "" || cfg.PayloadB == "" {
+			return fmt.Errorf("-payload-a and -payload-b must be set together")
+		}
+		if bodyA, err = os.ReadFile(cfg.PayloadA); err != nil {
+			return err
+		}
+		if bodyB, err = os.ReadFile(cfg.PayloadB); err != nil {
+			return err
+		}
+	}
+
+	subscribePayload, tokenPayload, err := getSecrets()
 	if err != nil {
-		if os.IsTimeout(err) {
-			appendToFile("./failed.txt", params.Imei)
+		return err
+	}
+
+	// An orchestrator that already holds a valid token can hand it over
+	// directly; the oauth round trip and refresh are skipped entirely.
+	token := cfg.Token
+	switch {
+	case token == "-":
+		raw, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("reading token from stdin: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	case strings.HasPrefix(token, "@"):
+		raw, err := os.ReadFile(token[1:])
+		if err != nil {
+			return fmt.Errorf("reading token file: %w", err)
 		}
-		return nil, fmt.Errorf("performing request: %w", err)
+		token = strings.TrimSpace(string(raw))
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != 200 {
-		appendToFile("./failed.txt", params.Imei)
-		return nil, fmt.Errorf("unexpected response %s", res.Status)
+	if cfg.Scope != "" {
+		tokenPayload.Scope = cfg.Scope
 	}
 
-	// TODO: Refresh token on 401
+	query := url.Values{}
+	for _, pair := range cfg.Query {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return fmt.Errorf("bad -query %q, expected key=value", pair)
+		}
+		query.Add(key, value)
+	}
 
-	if err = removeLine(params.Path, params.Imei); err != nil {
-		return nil, fmt.Errorf("removing line from text file: %w", err)
+	tokenFields := map[string]string{}
+	for _, mapping := range cfg.TokenFields {
+		canonical, actual, found := strings.Cut(mapping, "=")
+		if !found || canonical == "" || actual == "" {
+			return fmt.Errorf("bad -token-field %q, expected canonical=actual", mapping)
+		}
+		tokenFields[canonical] = actual
 	}
 
-	var result IResult
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("decoding json response: %w", err)
+	if !confirmProduction(cfg, subscribePayload.BaseURL) {
+		return fmt.Errorf("aborted before dispatching any request")
 	}
 
-	return result, nil
-}
+	// Off-peak scheduling: confirmation happens while the operator is
+	// still at the keyboard, then the wait runs before any token or
+	// network work so credentials are fetched fresh at the actual start.
+	if cfg.Delay > 0 || cfg.StartAt != "" {
+		start := time.Now().Add(cfg.Delay)
+		if cfg.StartAt != "" {
+			at, err := time.ParseInLocation("2006-01-02T15:04:05", cfg.StartAt, time.Local)
+			if err != nil {
+				if at, err = time.Parse(time.RFC3339, cfg.StartAt); err != nil {
+					return fmt.Errorf("bad -start-at %q, expected 2006-01-02T15:04:05", cfg.StartAt)
+				}
+			}
+			start = at
+		}
+		if wait := time.Until(start); wait > 0 {
+			log.Printf("waiting %s, run starts at %s", wait.Round(time.Second), start.Format(time.RFC3339))
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			select {
+			case <-time.After(wait):
+				signal.Stop(interrupt)
+			case <-interrupt:
+				signal.Stop(interrupt)
+				return fmt.Errorf("interrupted while waiting for the scheduled start")
+			}
+		}
+	}
 
-func main() {
+	if cfg.StreamResponse {
+		cfg.ResponseFormat = "ndjson"
+	}
 
-	args := os.Args[1:]
-	if len(args) != 2 {
-		fmt.Println("Provide arguments.")
-		fmt.Println("Example ./binaryname 12 ./sourcefile.txt")
-		return
+	// Pure-throughput mode: bodies are drained for connection reuse but
+	// never decoded, and successes produce no output at all.
+	if cfg.DrainResults {
+		cfg.ResponseFormat = "none"
 	}
 
-	assets, err := readFile(args[1])
+	var sinks []subscribe.ResultSink
+	if cfg.ResultsFile != "" {
+		sink, err := subscribe.NewFileSink(cfg.ResultsFile)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	client, err := subscribe.New(subscribe.Options{
+		Workers:           cfg.Workers,
+		Adaptive:          cfg.Adaptive,
+		MinWorkers:        cfg.MinWorkers,
+		MaxWorkers:        cfg.MaxWorkers,
+		Retries:           cfg.Retries,
+		AttemptTimeout:    cfg.AttemptTimeout,
+		AuthScheme:        cfg.AuthScheme,
+		CaptureHeaders:    cfg.CaptureHeaders,
+		Headers:           headers,
+		RawBody:           rawBody,
+		ContentType:       cfg.ContentType,
+		NoFollowRedirects: !cfg.FollowRedirects,
+		TraceTiming:       cfg.TraceTiming,
+		FailFast:          cfg.FailFast,
+		SignKey:           cfg.SignKey,
+		SignAlgo:          cfg.SignAlgo,
+		MaxBodyBytes:      cfg.MaxBodyBytes,
+		ResponseFormat:    cfg.ResponseFormat,
+		RampDuration:      cfg.RampDuration,
+		Spread:            cfg.Spread,
+		RecordFile:        cfg.RecordFile,
+		ReplayFile:        cfg.ReplayFile,
+		Method:            cfg.Method,
+		Paginate:          cfg.Paginate,
+		CursorField:       cfg.CursorField,
+		PrecheckURL:       cfg.PrecheckURL,
+		PrecheckWhen:      cfg.PrecheckWhen,
+		SkipFile:          cfg.SkipFile,
+		AllowFile:         cfg.AllowFile,
+		DenyFile:          cfg.DenyFile,
+		EventsFile:        cfg.EventsFile,
+		OtelEndpoint:      cfg.OtelEndpoint,
+		ClientCert:        cfg.ClientCert,
+		ClientKey:         cfg.ClientKey,
+		FailedLedger:      failedLedgerPath,
+		FailureReport:     cfg.FailureReport,
+		Abort4xxRatio:     cfg.Abort4xxRatio,
+		Backoff429:        cfg.Backoff429,
+		Backoff5xx:        cfg.Backoff5xx,
+		ValidateURL:       cfg.ValidateURL,
+		Sinks:             sinks,
+		RetryBudget:       cfg.RetryBudget,
+		WarmConnections:   cfg.WarmConnections,
+		DedupeRequests:    cfg.DedupeRequests,
+		PollInterval:      cfg.PollInterval,
+		PollTimeout:       cfg.PollTimeout,
+		TokenCache:        cfg.TokenCache,
+		TokenFields:       tokenFields,
+		LedgerLineNumbers: cfg.LedgerLineNumbers,
+		StallTimeout:      cfg.StallTimeout,
+		Webhook:           cfg.Webhook,
+		AttemptHistory:    cfg.AttemptHistory,
+		KeepInput:         cfg.ResumeOffset != "",
+		WorkerStagger:     cfg.WorkerStagger,
+		BaseURL:           subscribePayload.BaseURL,
+		Payload:           subscribePayload.Payload,
+		Token:             token,
+		TLSSessionCache:   cfg.TLSSessionCache,
+		RequireJSON:       cfg.RequireJSON,
+		DesiredState:      cfg.DesiredState,
+		PriorState:        cfg.PriorState,
+		WaitForReady:      cfg.WaitForReady,
+		HealthPath:        cfg.HealthPath,
+		Query:             query,
+		VerifyLength:      cfg.VerifyLength,
+		PrintCurl:         cfg.PrintCurl,
+		UnsafeCurl:        cfg.UnsafeCurl,
+		HashAlgo:          cfg.HashAlgo,
+		FloatNumbers:      cfg.FloatNumbers,
+		ErrorBody:         cfg.ErrorBody,
+		BodyA:             bodyA,
+		BodyB:             bodyB,
+		ABRatio:           cfg.ABRatio,
+		Auth:              tokenPayload,
+	})
 
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	wg := &sync.WaitGroup{}
-	workers, err := strconv.Atoi(args[0])
-	if err != nil {
-		fmt.Println(err)
-		return
+	// In CI a clean run should say nothing at all: buffer the log stream
+	// and replay it only when something failed.
+	var quietLog bytes.Buffer
+	if cfg.SummaryOnFailure {
+		log.SetOutput(&quietLog)
 	}
 
-	work := make(chan IWorkerParams, len(assets))
-	results := make(chan IWorkerResult, len(assets))
+	// SIGHUP forces a token refresh without restarting, for credentials
+	// rotated while a very long job is in flight.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for range reload {
+			log.Println("SIGHUP received, refreshing token")
+			if err := client.RefreshToken(); err != nil {
+				log.Printf("token refresh failed: %s", err)
+			} else {
+				log.Println("token refreshed")
+			}
+		}
+	}()
+
+	// Ctrl-C winds the run down through the abort path instead of killing
+	// the process, so the ledgers and checkpoint reflect completed work.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		if _, ok := <-interrupt; ok {
+			client.Abort(fmt.Errorf("interrupted"))
+		}
+	}()
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	// Failures always log in full; successes can be sampled so they don't
+	// drown the failures at high concurrency.
+	color := colorsEnabled()
+	var successes, failures int
+	var written []string
+
+	// The TUI takes over stdout; per-result printing is suppressed while
+	// it is active so the block is not torn apart by scrolling output.
+	var tui *ITui
+	if cfg.Tui && !cfg.SummaryOnFailure {
+		tui = newTui(len(assets), client)
+	}
 
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go doWork(client, work, results, wg)
+	// Results carry the IMEI, not the input line; map it back so completed
+	// work can advance the offset checkpoint.
+	lineFor := map[string]int{}
+	if checkpoint != nil {
+		for _, asset := range assets {
+			lineFor[asset.Imei] = asset.LineNo
+		}
 	}
 
-	subscribePayload, tokenPayload := getSecrets()
+	handle := func(result subscribe.Result) {
+		tui.Observe(result)
+		if result.Err() != nil {
+			failures++
+			if tui == nil {
+				log.Println(paint(color, colorRed, result.Err().Error()))
+			}
+			return
+		}
+		successes++
+		checkpoint.Done(lineFor[fmt.Sprint(result.Value()["imei"])])
+		if cfg.Verify != "" && result.Value()["_already_done"] != true {
+			written = append(written, fmt.Sprint(result.Value()["imei"]))
+		}
+		if cfg.DrainResults {
+			return
+		}
+		if cfg.SummaryOnFailure || tui != nil {
+			return
+		}
+		if cfg.LogSample > 1 && successes%cfg.LogSample != 0 {
+			return
+		}
+		out := fmt.Sprint(result.Value())
+		if cfg.JsonIndent {
+			if raw, err := json.MarshalIndent(result.Value(), "", "  "); err == nil {
+				out = string(raw)
+			}
+		}
+		fmt.Println(paint(color, colorGreen, out))
+		if cfg.AttemptHistory && len(result.Attempts()) > 1 {
+			log.Printf("attempts: %+v", result.Attempts())
+		}
+	}
 
-	token, err := getToken(tokenPayload)
+	// Chunking is a coarse alternative to rate limiting: the pool drains
+	// one slice of the input, reports it, then sits out the pause so the
+	// API gets breathing room between bursts.
+	chunks := [][]subscribe.Asset{assets}
+	if cfg.ChunkSize > 0 && len(assets) > cfg.ChunkSize {
+		chunks = nil
+		for start := 0; start < len(assets); start += cfg.ChunkSize {
+			end := start + cfg.ChunkSize
+			if end > len(assets) {
+				end = len(assets)
+			}
+			chunks = append(chunks, assets[start:end])
+		}
+	}
 
-	if err != nil {
-		fmt.Println(err)
-		return
+	// The checkpoint is also written while the run is in flight, so an
+	// interrupted or aborted run — the main reason to resume at all —
+	// still persists how far it got.
+	if checkpoint != nil {
+		checkpointStop := make(chan struct{})
+		defer close(checkpointStop)
+		go func() {
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-checkpointStop:
+					return
+				case <-ticker.C:
+					if err := checkpoint.Write(); err != nil {
+						log.Printf("checkpoint: %s", err)
+					}
+				}
+			}
+		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	var runErr error
+	for i, chunk := range chunks {
+		if i > 0 && cfg.ChunkPause > 0 {
+			log.Printf("pausing %s before chunk %d/%d", cfg.ChunkPause, i+1, len(chunks))
+			time.Sleep(cfg.ChunkPause)
+		}
+		chunkSuccesses, chunkFailures := successes, failures
+		runErr = client.Run(chunk, handle)
+		if len(chunks) > 1 {
+			log.Printf("chunk %d/%d: %d succeeded, %d failed of %d",
+				i+1, len(chunks), successes-chunkSuccesses, failures-chunkFailures, len(chunk))
+		}
+		if runErr != nil {
+			break
+		}
+	}
+
+	tui.Close()
 
-	for _, imei := range assets {
-		work <- IWorkerParams{
-			Url:     fmt.Sprintf("%s/services/obdstack/v1/assets/%s/subscribe", subscribePayload.BaseURL, imei),
-			Method:  "POST",
-			Imei:    imei,
-			Payload: subscribePayload.Payload,
-			Token:   token,
-			Path:    args[1],
+	if cfg.SummaryOnFailure {
+		log.SetOutput(os.Stderr)
+		if failures > 0 || runErr != nil {
+			os.Stderr.Write(quietLog.Bytes())
 		}
 	}
 
-	close(work)
+	if runErr != nil {
+		if err := checkpoint.Write(); err != nil {
+			log.Printf("checkpoint: %s", err)
+		}
+		return runErr
+	}
 
-	for result := range results {
-		if result.Err() != nil {
-			log.Println(result.Err())
+	if err := checkpoint.Finish(); err != nil {
+		return err
+	}
+
+	// The verify pass runs after everything was dispatched, so a transient
+	// write-then-read race on the API side has had time to settle.
+	if cfg.Verify != "" && len(written) > 0 {
+		if mismatches := client.Verify(written, cfg.Verify); mismatches > 0 {
+			return fmt.Errorf("verify: %d of %d written subscriptions do not match %s", mismatches, len(written), cfg.Verify)
 		}
-		fmt.Println(result.Value())
+		log.Printf("verify: all %d written subscriptions match %s", len(written), cfg.Verify)
 	}
 
-	fmt.Println("Done")
+	// With -output-dir the closing summary is also archived next to the
+	// other artifacts, so the run's outcome survives the terminal scroll.
+	if runDir != "." {
+		summary := fmt.Sprintf("Done: %d succeeded, %d failed of %d\n", successes, failures, len(assets))
+		summary += client.HostSummary()
+		if err := os.WriteFile(filepath.Join(runDir, "summary.txt"), []byte(summary), 0644); err != nil {
+			log.Printf("cannot write summary file: %s", err)
+		}
+	}
+
+	if cfg.SummaryOnFailure && failures == 0 {
+		return nil
+	}
+
+	summaryColor := colorGreen
+	if failures > 0 {
+		summaryColor = colorYellow
+	}
+	if successes == 0 && failures > 0 {
+		summaryColor = colorRed
+	}
+	fmt.Println(paint(color, summaryColor, fmt.Sprintf("Done: %d succeeded, %d failed of %d", successes, failures, len(assets))))
+	if table := client.HostSummary(); table != "" {
+		fmt.Print(table)
+	}
+
+	// CI keys on the exit code: a -summary-only-on-failure run that
+	// recorded failures must fail the job, not just print about it.
+	if cfg.SummaryOnFailure && failures > 0 {
+		return fmt.Errorf("%d of %d requests failed", failures, len(assets))
+	}
+	return nil
 }
@@ -0,0 +1,114 @@
+package subscribe
+
+import (
+	"sync"
+	"time"
+)
+
+// IAdaptive ramps the worker pool AIMD-style: while latency and error
+// rate stay healthy one worker is added per interval, and when they
+// degrade half the pool is stopped.
+type IAdaptive struct {
+	min      int
+	max      int
+	mu       sync.Mutex
+	total    time.Duration
+	count    int
+	failed   int
+	baseline time.Duration
+}
+
+func newAdaptive(min, max int) *IAdaptive {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &IAdaptive{min: min, max: max}
+}
+
+// Observe records one finished request; safe to call on a nil receiver
+// so the fixed-size pool can skip the bookkeeping entirely.
+func (a *IAdaptive) Observe(d time.Duration, failed bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.total += d
+	a.count++
+	if failed {
+		a.failed++
+	}
+	a.mu.Unlock()
+}
+
+// window drains the stats gathered since the last call.
+func (a *IAdaptive) window() (avg time.Duration, errRate float64, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n = a.count
+	if n > 0 {
+		avg = a.total / time.Duration(n)
+		errRate = float64(a.failed) / float64(n)
+	}
+	a.total, a.count, a.failed = 0, 0, 0
+	return avg, errRate, n
+}
+
+// start launches the minimum pool synchronously so the caller's
+// WaitGroup is already non-zero before anyone waits on it.
+func (a *IAdaptive) start(spawn func(chan struct{})) []chan struct{} {
+	var quits []chan struct{}
+	for i := 0; i < a.min; i++ {
+		quit := make(chan struct{})
+		quits = append(quits, quit)
+		spawn(quit)
+	}
+	return quits
+}
+
+// run adjusts the pool every interval until done is closed. spawn must
+// start one worker that exits when the passed channel is closed.
+func (a *IAdaptive) run(spawn func(chan struct{}), quits []chan struct{}, done <-chan struct{}) {
+	addWorker := func() {
+		quit := make(chan struct{})
+		quits = append(quits, quit)
+		spawn(quit)
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			avg, errRate, n := a.window()
+			if n == 0 {
+				continue
+			}
+			if a.baseline == 0 || avg < a.baseline {
+				a.baseline = avg
+			}
+
+			healthy := errRate <= 0.05 && avg <= 2*a.baseline
+			if healthy && len(quits) < a.max {
+				addWorker()
+				continue
+			}
+			if !healthy && len(quits) > a.min {
+				target := len(quits) / 2
+				if target < a.min {
+					target = a.min
+				}
+				for len(quits) > target {
+					quit := quits[len(quits)-1]
+					quits = quits[:len(quits)-1]
+					close(quit)
+				}
+			}
+		}
+	}
+}
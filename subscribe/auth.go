@@ -0,0 +1,250 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type IRefreshRequest struct {
+	GrantType    string `json:"grant_type"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ITokenSource hands out the current access token and refreshes it when
+// a worker reports it expired.
+type ITokenSource struct {
+	client    *http.Client
+	cred      IGetTokenRequest
+	cachePath string
+	fields    map[string]string
+	static    bool
+	mu        sync.Mutex
+	token     ITokenResponse
+}
+
+func newTokenSource(client *http.Client, cred IGetTokenRequest, cachePath string, fields map[string]string, static string) (*ITokenSource, error) {
+	// A caller-supplied token is used verbatim: no token request at
+	// startup, and no way to mint a replacement on a 401.
+	if static != "" {
+		return &ITokenSource{static: true, token: ITokenResponse{AccessToken: static}}, nil
+	}
+
+	source := &ITokenSource{client: client, cred: cred, cachePath: cachePath, fields: fields}
+
+	if token, ok := loadCachedToken(cachePath); ok {
+		source.token = token
+		return source, nil
+	}
+
+	token, err := fetchToken(client, cred.BaseURL, cred, fields)
+	if err != nil {
+		return nil, err
+	}
+	warnOnClockSkew(token)
+	warnOnMissingScope(cred.Scope, token.Scope)
+	saveCachedToken(cachePath, token)
+	source.token = token
+	return source, nil
+}
+
+// loadCachedToken reuses a token persisted by an earlier run when it is
+// still comfortably within its expiry window.
+func loadCachedToken(path string) (ITokenResponse, bool) {
+	var t ITokenResponse
+	if path == "" {
+		return t, false
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return t, false
+	}
+	if err := json.Unmarshal(raw, &t); err != nil {
+		log.Printf("ignoring unreadable token cache %s: %s", path, err)
+		return t, false
+	}
+
+	if t.AccessToken == "" || t.CreatedAt == 0 || t.ExpiresIn == 0 {
+		return t, false
+	}
+	expiry := time.Unix(int64(t.CreatedAt+t.ExpiresIn), 0)
+	if time.Until(expiry) < clockSkewWarnThreshold {
+		return t, false
+	}
+
+	return t, true
+}
+
+// saveCachedToken persists the token with owner-only permissions; it is a
+// credential, so failing to write is only worth a log line.
+func saveCachedToken(path string, t ITokenResponse) {
+	if path == "" {
+		return
+	}
+	if t.CreatedAt == 0 {
+		t.CreatedAt = int(time.Now().Unix())
+	}
+	raw, err := json.Marshal(t)
+	if err == nil {
+		err = os.WriteFile(path, raw, 0600)
+	}
+	if err != nil {
+		log.Printf("cannot write token cache %s: %s", path, err)
+	}
+}
+
+// warnOnMissingScope checks that every requested scope was actually
+// granted. A narrower grant usually surfaces later as confusing 403s, so
+// say it up front.
+func warnOnMissingScope(requested, granted string) {
+	if requested == "" {
+		return
+	}
+
+	have := map[string]bool{}
+	for _, scope := range strings.Fields(granted) {
+		have[scope] = true
+	}
+
+	for _, scope := range strings.Fields(requested) {
+		if !have[scope] {
+			log.Printf("warning: requested scope %q was not granted (granted: %q)", scope, granted)
+		}
+	}
+}
+
+const clockSkewWarnThreshold = 30 * time.Second
+
+// warnOnClockSkew compares the IdP's created_at with the local clock.
+// A skewed VM clock leads to hard-to-diagnose early 401s, so surface it
+// once at startup.
+func warnOnClockSkew(t ITokenResponse) {
+	if t.CreatedAt == 0 {
+		return
+	}
+
+	skew := time.Since(time.Unix(int64(t.CreatedAt), 0))
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > clockSkewWarnThreshold {
+		log.Printf("warning: token created_at is %s away from the local clock, check NTP", skew.Round(time.Second))
+	}
+}
+
+func (s *ITokenSource) Current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token.AccessToken
+}
+
+// Refresh exchanges the stored refresh token for a new access token,
+// falling back to the heavier password grant only when the refresh
+// token is rejected.
+func (s *ITokenSource) Refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.static {
+		return fmt.Errorf("externally supplied token was rejected and cannot be refreshed")
+	}
+
+	if s.token.RefreshToken != "" {
+		token, err := fetchToken(s.client, s.cred.BaseURL, IRefreshRequest{
+			GrantType:    "refresh_token",
+			RefreshToken: s.token.RefreshToken,
+		}, s.fields)
+		if err == nil && token.AccessToken != "" {
+			s.token = token
+			saveCachedToken(s.cachePath, token)
+			return nil
+		}
+		log.Println("refresh token rejected, falling back to password grant")
+	}
+
+	token, err := fetchToken(s.client, s.cred.BaseURL, s.cred, s.fields)
+	if err != nil {
+		return err
+	}
+	s.token = token
+	saveCachedToken(s.cachePath, token)
+
+	return nil
+}
+
+// fetchToken posts the given grant payload to the oauth endpoint using
+// the shared client so proxy, TLS and timeout settings apply here too.
+func fetchToken(client *http.Client, baseURL string, grant interface{}, fields map[string]string) (ITokenResponse, error) {
+	var t ITokenResponse
+
+	payload, err := json.Marshal(grant)
+	if err != nil {
+		return t, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/oauth/token", baseURL), strings.NewReader(string(payload)))
+	if err != nil {
+		return t, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return t, err
+	}
+
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	return decodeTokenResponse(res.Body, fields)
+}
+
+// decodeTokenResponse reads the IdP's token payload. With a field
+// mapping configured it decodes a flexible map and extracts values by
+// the mapped names, so camelCase IdPs work without code changes.
+func decodeTokenResponse(body io.Reader, fields map[string]string) (ITokenResponse, error) {
+	var t ITokenResponse
+	if len(fields) == 0 {
+		return t, json.NewDecoder(body).Decode(&t)
+	}
+
+	var raw map[string]interface{}
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return t, err
+	}
+
+	name := func(canonical string) string {
+		if mapped, ok := fields[canonical]; ok {
+			return mapped
+		}
+		return canonical
+	}
+	text := func(canonical string) string {
+		value, _ := raw[name(canonical)].(string)
+		return value
+	}
+	number := func(canonical string) int {
+		value, _ := raw[name(canonical)].(float64)
+		return int(value)
+	}
+
+	t.AccessToken = text("access_token")
+	t.TokenType = text("token_type")
+	t.RefreshToken = text("refresh_token")
+	t.Scope = text("scope")
+	t.ExpiresIn = number("expires_in")
+	t.CreatedAt = number("created_at")
+
+	return t, nil
+}
@@ -0,0 +1,109 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type ICassetteEntry struct {
+	Key    string `json:"key"`
+	Method string `json:"method"`
+	Url    string `json:"url"`
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// ICassette saves each (request, response) pair to an NDJSON file in
+// -record mode and serves responses from that file in -replay mode, so
+// runs can be developed and tested offline. Requests are matched by
+// method+url+body hash.
+type ICassette struct {
+	recordPath string
+	replaying  bool
+	mu         sync.Mutex
+	entries    map[string]ICassetteEntry
+}
+
+func newCassette(recordPath, replayPath string) (*ICassette, error) {
+	if recordPath == "" && replayPath == "" {
+		return nil, nil
+	}
+	if recordPath != "" && replayPath != "" {
+		return nil, fmt.Errorf("-record and -replay are mutually exclusive")
+	}
+
+	c := &ICassette{recordPath: recordPath, entries: map[string]ICassetteEntry{}}
+	if replayPath != "" {
+		c.replaying = true
+		lines, err := readFile(replayPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading cassette: %w", err)
+		}
+		for _, line := range lines {
+			var entry ICassetteEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return nil, fmt.Errorf("parsing cassette: %w", err)
+			}
+			c.entries[entry.Key] = entry
+		}
+	}
+
+	return c, nil
+}
+
+func (c *ICassette) Replaying() bool {
+	return c != nil && c.replaying
+}
+
+func (c *ICassette) Recording() bool {
+	return c != nil && !c.replaying
+}
+
+// Cassette files outlive the run, so their keys always use the stable
+// sha256 digest regardless of the configured -hash.
+func cassetteKey(method, url string, body []byte) string {
+	return digestSHA256(append([]byte(method+" "+url+" "), body...))
+}
+
+// Replay synthesizes a response from the cassette, or nil when the
+// cassette holds no matching entry.
+func (c *ICassette) Replay(method, url string, body []byte) *http.Response {
+	c.mu.Lock()
+	entry, ok := c.entries[cassetteKey(method, url, body)]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode: entry.Status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(entry.Body)),
+	}
+}
+
+func (c *ICassette) Record(method, url string, status int, reqBody, resBody []byte) {
+	entry := ICassetteEntry{
+		Key:    cassetteKey(method, url, reqBody),
+		Method: method,
+		Url:    url,
+		Status: status,
+		Body:   string(resBody),
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c.mu.Lock()
+	appendToFile(c.recordPath, string(raw))
+	c.mu.Unlock()
+}
@@ -0,0 +1,1945 @@
+// Package subscribe drives concurrent subscribe requests against the
+// asset API. The binary in the repository root is a thin CLI on top of
+// it; other programs can import the package and use Client, Options and
+// Run directly.
+package subscribe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// MaxLineLength bounds how long one input line may be. A line beyond it
+// fails with an error naming the offending line instead of the scanner's
+// silent truncation.
+var MaxLineLength = bufio.MaxScanTokenSize
+
+type IResult map[string]interface{}
+
+// Result is what Run hands to the caller for every processed asset.
+type Result interface {
+	Err() error
+	Value() IResult
+	Attempts() []AttemptInfo
+}
+
+// AttemptInfo describes one attempt of a request, so patterns like
+// "always succeeds on the second try" become visible.
+type AttemptInfo struct {
+	Reason   string        `json:"reason,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type IJsonResult struct {
+	err      error
+	value    IResult
+	attempts []AttemptInfo
+}
+
+func (r IJsonResult) Err() error {
+	return r.err
+}
+
+func (r IJsonResult) Value() IResult {
+	return r.value
+}
+
+func (r IJsonResult) Attempts() []AttemptInfo {
+	return r.attempts
+}
+
+type ITokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	CreatedAt    int    `json:"created_at"`
+}
+
+type ISubscribePayload struct {
+	Offer               string `json:"offer"`
+	Account             string `json:"account"`
+	RebootAfterNextTrip bool   `json:"reboot_after_next_trip"`
+}
+
+type IGetTokenRequest struct {
+	BaseURL   string `json:"base_url"`
+	GrantType string `json:"grant_type"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+type Asset struct {
+	Imei     string
+	ETag     string
+	Priority int
+	Reboot   *bool
+	Meta     string
+	Line     string
+	LineNo   int
+	Source   string
+}
+
+// ParseAssets splits input lines into their columns. The first column is
+// the IMEI; the extra columns are recognized by shape rather than by
+// position. A true/false column overrides the payload's
+// reboot_after_next_trip for that asset, and a bare integer is a priority
+// (higher dispatches first) — real ETags are quoted per RFC 7232, so a
+// number can never be one. The remaining columns keep their positional
+// meaning: first an ETag for If-Match, then an opaque metadata value the
+// tool never interprets but copies into results and ledger entries, so
+// callers keep the correlation to their own records.
+func ParseAssets(lines []string) []Asset {
+	var assets []Asset
+	for i, line := range lines {
+		parts := strings.Split(line, ",")
+		asset := Asset{Imei: strings.TrimSpace(parts[0]), Line: line, LineNo: i + 1}
+		column := 0
+		prioritized := false
+		for _, part := range parts[1:] {
+			part = strings.TrimSpace(part)
+			if strings.EqualFold(part, "true") || strings.EqualFold(part, "false") {
+				reboot := strings.EqualFold(part, "true")
+				asset.Reboot = &reboot
+				continue
+			}
+			if priority, err := strconv.Atoi(part); err == nil && !prioritized {
+				asset.Priority = priority
+				prioritized = true
+				continue
+			}
+			column++
+			switch column {
+			case 1:
+				asset.ETag = part
+			case 2:
+				asset.Meta = part
+			}
+		}
+		assets = append(assets, asset)
+	}
+	return assets
+}
+
+// sortByPriority dispatches higher-priority assets first while the stable
+// sort keeps file order for assets without a priority column.
+func sortByPriority(assets []Asset) {
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assets[i].Priority > assets[j].Priority
+	})
+}
+
+// ICounts breaks down what an input would produce without running it.
+type ICounts struct {
+	Valid      int
+	Invalid    int
+	Duplicates int
+	Filtered   int
+}
+
+// Count runs the read/filter pipeline over the assets and reports how
+// many would actually be dispatched, without touching the network.
+func Count(assets []Asset, allowFile, denyFile string) (ICounts, error) {
+	var counts ICounts
+
+	allow, err := loadSet(allowFile)
+	if err != nil {
+		return counts, err
+	}
+	deny, err := loadSet(denyFile)
+	if err != nil {
+		return counts, err
+	}
+
+	seen := map[string]bool{}
+	for _, asset := range assets {
+		switch {
+		case asset.Imei == "":
+			counts.Invalid++
+		case seen[asset.Imei]:
+			counts.Duplicates++
+		case allow != nil && !allow[asset.Imei], deny[asset.Imei]:
+			seen[asset.Imei] = true
+			counts.Filtered++
+		default:
+			seen[asset.Imei] = true
+			counts.Valid++
+		}
+	}
+
+	return counts, nil
+}
+
+// ReadLinesAt reads newline-separated lines starting at a byte offset.
+// Alongside the lines it reports, for each one, the offset just past that
+// line, which is what the resume checkpoint persists as progress. A
+// partial trailing line is left unconsumed, so an append-only input can
+// be resumed cheaply without a line-based ledger.
+func ReadLinesAt(path string, offset int64) ([]string, []int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	var lines []string
+	var ends []int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		offset += int64(len(line))
+		ends = append(ends, offset)
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+
+	return lines, ends, nil
+}
+
+// LoadAssets reads every source file into one asset list, tagging each
+// asset with the file it came from so progress tracking stays correct
+// per source. With onlyFailed the files are treated as failed ledgers:
+// reason columns are stripped and the run starts from a fresh copy.
+func LoadAssets(files []string, onlyFailed bool, failedLedger string) ([]Asset, error) {
+	var assets []Asset
+	for _, path := range files {
+		lines, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if onlyFailed {
+			// Work from a stripped copy so the run writes a fresh failed file.
+			retryPath := fmt.Sprintf("%s.retry", path)
+			if err := writeLines(retryPath, stripReasons(lines)); err != nil {
+				return nil, err
+			}
+			if path == failedLedger {
+				os.Remove(path)
+			}
+			path = retryPath
+			if lines, err = readFile(path); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, asset := range ParseAssets(lines) {
+			asset.Source = path
+			assets = append(assets, asset)
+		}
+	}
+	return assets, nil
+}
+
+// Options carries everything a Client needs; the zero value of most
+// fields simply disables the matching feature, mirroring the CLI flags.
+type Options struct {
+	Workers           int
+	Adaptive          bool
+	MinWorkers        int
+	MaxWorkers        int
+	Retries           int
+	Method            string
+	Paginate          bool
+	PrecheckURL       string
+	PrecheckWhen      string
+	CursorField       string
+	Timeout           time.Duration
+	AttemptTimeout    time.Duration
+	AuthScheme        string
+	CaptureHeaders    []string
+	Headers           map[string]string
+	RawBody           []byte
+	ContentType       string
+	NoFollowRedirects bool
+	TraceTiming       bool
+	FailFast          bool
+	SignKey           string
+	SignAlgo          string
+	MaxBodyBytes      int64
+	ResponseFormat    string
+	RampDuration      time.Duration
+	Spread            time.Duration
+	RecordFile        string
+	ReplayFile        string
+	SkipFile          string
+	AllowFile         string
+	DenyFile          string
+	EventsFile        string
+	OtelEndpoint      string
+	ClientCert        string
+	ClientKey         string
+	FailedLedger      string
+	TokenCache        string
+	TokenFields       map[string]string
+	LedgerLineNumbers bool
+	StallTimeout      time.Duration
+	Webhook           string
+	AttemptHistory    bool
+	KeepInput         bool
+	WorkerStagger     time.Duration
+	FailureReport     string
+	Abort4xxRatio     float64
+	Backoff429        time.Duration
+	Backoff5xx        time.Duration
+	ValidateURL       string
+	Sinks             []ResultSink
+	RetryBudget       int
+	WarmConnections   bool
+	DedupeRequests    bool
+	PollInterval      time.Duration
+	PollTimeout       time.Duration
+	Token             string
+	TLSSessionCache   int
+	RequireJSON       bool
+	DesiredState      string
+	PriorState        string
+	WaitForReady      time.Duration
+	HealthPath        string
+	Query             url.Values
+	VerifyLength      bool
+	PrintCurl         bool
+	UnsafeCurl        bool
+	HashAlgo          string
+	FloatNumbers      bool
+	ErrorBody         string
+	BodyA             []byte
+	BodyB             []byte
+	ABRatio           float64
+	BaseURL           string
+	Payload           ISubscribePayload
+	Auth              IGetTokenRequest
+}
+
+// Client ties the HTTP client, token source and per-run helpers
+// together. Build one with New and feed it assets via Run.
+type Client struct {
+	opts         Options
+	http         *http.Client
+	tracer       *ITracer
+	signer       *ISigner
+	decode       IDecoder
+	cassette     *ICassette
+	tokens       *ITokenSource
+	ledger       *ILedger
+	webhook      *IWebhook
+	hosts        *IHostTracker
+	abort        chan struct{}
+	triggerAbort func(error)
+	ratio4xx     IRatioTracker
+	retriesSpent int64
+	budgetOnce   sync.Once
+	fdLimitOnce  sync.Once
+	failureMu    sync.Mutex
+	failures     map[string]*IFailureBucket
+	dedupeMu     sync.Mutex
+	dedupeSeen   map[string]bool
+	hash         IHasher
+}
+
+func New(opts Options) (*Client, error) {
+	if opts.AuthScheme == "" {
+		opts.AuthScheme = "Bearer"
+	}
+	if opts.ResponseFormat == "" {
+		opts.ResponseFormat = "json"
+	}
+	if opts.SignAlgo == "" {
+		opts.SignAlgo = "sha256"
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.FailedLedger == "" {
+		opts.FailedLedger = "./failed.txt"
+	}
+	if opts.Method == "" {
+		opts.Method = "POST"
+	}
+	if opts.CursorField == "" {
+		opts.CursorField = "next"
+	}
+
+	// Every in-flight request holds a descriptor; a pool sized past the
+	// fd limit produces cryptic "too many open files" errors scattered
+	// across the run. Clamp the pool and say so once, up front.
+	if limit := openFileLimit(); limit > fdReserve {
+		budget := int(limit - fdReserve)
+		if opts.Workers > budget {
+			log.Printf("capping -workers %d to %d to stay under the open-file limit of %d (raise ulimit -n for more)", opts.Workers, budget, limit)
+			opts.Workers = budget
+		}
+		if opts.MaxWorkers > budget {
+			opts.MaxWorkers = budget
+		}
+	}
+
+	tlsConfig, err := buildTLSConfig(opts.ClientCert, opts.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Session resumption lets repeated connections to the same host skip
+	// the full handshake; on a big run against one endpoint the handshakes
+	// otherwise dominate connection setup.
+	if opts.TLSSessionCache > 0 {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(opts.TLSSessionCache)
+	}
+
+	// unix:// base URLs talk to a local sidecar; rewrite them to a
+	// synthetic host the transport routes back to the socket.
+	var socketPath string
+	if socket, rewritten := splitUnixURL(opts.BaseURL); socket != "" {
+		socketPath = socket
+		opts.BaseURL = rewritten
+	}
+	if socket, rewritten := splitUnixURL(opts.Auth.BaseURL); socket != "" {
+		socketPath = socket
+		opts.Auth.BaseURL = rewritten
+	}
+
+	httpClient := &http.Client{Timeout: opts.Timeout}
+	if opts.NoFollowRedirects {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if tlsConfig != nil || socketPath != "" {
+		// Start from a clone of the default transport so its proxy
+		// handling, HTTP/2 support and timeouts survive the overrides
+		// below; a bare &http.Transport{} would silently drop all of them.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
+		}
+		// The stock two idle connections per host guarantee churn under a
+		// bigger pool: size the idle set to the workers that feed it.
+		pool := opts.Workers
+		if opts.Adaptive && opts.MaxWorkers > pool {
+			pool = opts.MaxWorkers
+		}
+		if pool > transport.MaxIdleConnsPerHost {
+			transport.MaxIdleConnsPerHost = pool
+		}
+		if pool > transport.MaxIdleConns {
+			transport.MaxIdleConns = pool
+		}
+		if socketPath != "" {
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				if strings.HasPrefix(addr, "unix:") {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				}
+				return dialer.DialContext(ctx, network, addr)
+			}
+		}
+		httpClient.Transport = transport
+	}
+
+	signer, err := newSigner(opts.SignKey, opts.SignAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	decode, err := newDecoder(opts.ResponseFormat, opts.FloatNumbers)
+	if err != nil {
+		return nil, err
+	}
+
+	cassette, err := newCassette(opts.RecordFile, opts.ReplayFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := newHasher(opts.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := newTokenSource(httpClient, opts.Auth, opts.TokenCache, opts.TokenFields, opts.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		opts:       opts,
+		http:       httpClient,
+		tracer:     newTracer(opts.OtelEndpoint, httpClient),
+		signer:     signer,
+		decode:     decode,
+		cassette:   cassette,
+		tokens:     tokens,
+		ledger:     newLedger(opts.FailedLedger),
+		webhook:    newWebhook(opts.Webhook, httpClient),
+		hosts:      newHostTracker(),
+		failures:   map[string]*IFailureBucket{},
+		dedupeSeen: map[string]bool{},
+		hash:       hash,
+	}, nil
+}
+
+type IWorkerParams struct {
+	Url     string
+	Method  string
+	Imei    string
+	ETag    string
+	Meta    string
+	Variant string
+	Line    string
+	LineNo  int
+	Payload ISubscribePayload
+	Body    []byte
+	Path    string
+}
+
+// Run dispatches every asset through the worker pool and calls handle
+// for each result. It returns once all assets have been processed.
+func (c *Client) Run(assets []Asset, handle func(Result)) error {
+	// A deployment race can start the tool before the API listens; rather
+	// than failing every request, wait for the health endpoint to answer.
+	if c.opts.WaitForReady > 0 {
+		if err := c.waitForReady(); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.ValidateURL != "" {
+		if err := c.validatePayload(); err != nil {
+			return err
+		}
+	}
+
+	if c.opts.WarmConnections {
+		c.warmConnections()
+	}
+
+	// Flush the buffered ledger and trace writers even when the run winds
+	// down abnormally; partial progress must always be persisted.
+	defer func() {
+		c.ledger.Flush()
+		c.tracer.Flush()
+	}()
+
+	wg := &sync.WaitGroup{}
+	work := make(chan IWorkerParams, len(assets))
+	results := make(chan Result, len(assets))
+
+	// abort is closed on the first failure under FailFast or by the stall
+	// watchdog; the feeder, the workers and in-flight requests all watch
+	// it so the run winds down cleanly. The cause is read back at the end
+	// of Run while the watchdog goroutines may still be firing, so it is
+	// guarded by its own mutex on top of the once.
+	abort := make(chan struct{})
+	var abortOnce sync.Once
+	var abortMu sync.Mutex
+	var abortErr error
+	c.abort = abort
+	c.triggerAbort = func(err error) {
+		abortOnce.Do(func() {
+			abortMu.Lock()
+			abortErr = err
+			abortMu.Unlock()
+			close(abort)
+		})
+	}
+
+	var adaptive *IAdaptive
+	spawn := func(quit chan struct{}) {
+		wg.Add(1)
+		go c.doWork(adaptive, work, results, wg, quit, abort)
+	}
+
+	workerStop := make(chan struct{})
+	defer close(workerStop)
+
+	if c.opts.Adaptive {
+		adaptive = newAdaptive(c.opts.MinWorkers, c.opts.MaxWorkers)
+		go adaptive.run(spawn, adaptive.start(spawn), workerStop)
+	} else {
+		workers := c.opts.Workers
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			// Staggering the launches spreads out connection establishment,
+			// which some servers reject when it arrives as one burst.
+			if c.opts.WorkerStagger > 0 && i > 0 {
+				time.Sleep(c.opts.WorkerStagger)
+			}
+			spawn(nil)
+		}
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	progress := newProgress(len(assets))
+	if c.opts.EventsFile != "" {
+		go emitEvents(c.opts.EventsFile, progress, workerStop)
+	}
+
+	skipList := newSkipList(c.opts.SkipFile, workerStop)
+
+	// The watchdog catches an API that accepts connections but stops
+	// answering: when no result lands inside StallTimeout, abort.
+	var lastResult int64
+	atomic.StoreInt64(&lastResult, time.Now().UnixNano())
+	if c.opts.StallTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-workerStop:
+					return
+				case <-ticker.C:
+					if time.Since(time.Unix(0, atomic.LoadInt64(&lastResult))) > c.opts.StallTimeout {
+						c.triggerAbort(fmt.Errorf("no result for %s, aborting stalled run", c.opts.StallTimeout))
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	// Incremental reconciliation: with a desired-state file each body is
+	// reduced to the fields differing from the prior state, and assets
+	// that are already in the desired state are not dispatched at all.
+	var desiredState, priorState map[string]map[string]interface{}
+	if c.opts.DesiredState != "" {
+		state, err := loadStateFile(c.opts.DesiredState)
+		if err != nil {
+			return err
+		}
+		desiredState = state
+		if c.opts.PriorState != "" {
+			if priorState, err = loadStateFile(c.opts.PriorState); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The allow/deny lists are applied in the feeder, after dedupe and
+	// resume have shaped the asset list: allowlist first, denylist second.
+	allow, err := loadSet(c.opts.AllowFile)
+	if err != nil {
+		return err
+	}
+	deny, err := loadSet(c.opts.DenyFile)
+	if err != nil {
+		return err
+	}
+
+	sortByPriority(assets)
+
+	// Extra query parameters apply to every request; encoding once up
+	// front also normalizes ordering and escaping.
+	query := ""
+	if len(c.opts.Query) > 0 {
+		query = "?" + c.opts.Query.Encode()
+	}
+
+	rampStart := time.Now()
+
+	var notAllowed, denied int
+feed:
+	for _, asset := range assets {
+		if delay := rampDelay(rampStart, c.opts.RampDuration); delay > 0 {
+			time.Sleep(delay)
+		}
+		if allow != nil && !allow[asset.Imei] {
+			notAllowed++
+			continue
+		}
+		if deny[asset.Imei] {
+			denied++
+			continue
+		}
+		if skipList.Has(asset.Imei) {
+			log.Printf("skipping %s, found in %s", asset.Imei, c.opts.SkipFile)
+			continue
+		}
+		payload := c.opts.Payload
+		if asset.Reboot != nil {
+			payload.RebootAfterNextTrip = *asset.Reboot
+		}
+		var body []byte
+		variant := ""
+		// A/B canary: each IMEI draws its variant from the seeded source,
+		// so the same -seed replays the same assignment.
+		if c.opts.BodyA != nil && c.opts.BodyB != nil {
+			if rand.Float64() < c.opts.ABRatio {
+				body, variant = c.opts.BodyA, "A"
+			} else {
+				body, variant = c.opts.BodyB, "B"
+			}
+		}
+		if desiredState != nil {
+			desired, ok := desiredState[asset.Imei]
+			if !ok {
+				log.Printf("skipping %s, not in %s", asset.Imei, c.opts.DesiredState)
+				continue
+			}
+			changed := diffFields(desired, priorState[asset.Imei])
+			if len(changed) == 0 {
+				log.Printf("skipping %s, already in the desired state", asset.Imei)
+				continue
+			}
+			body, _ = json.Marshal(changed)
+		}
+		select {
+		case work <- IWorkerParams{
+			Url:     fmt.Sprintf("%s/services/obdstack/v1/assets/%s/subscribe%s", c.opts.BaseURL, asset.Imei, query),
+			Method:  c.opts.Method,
+			Imei:    asset.Imei,
+			ETag:    asset.ETag,
+			Meta:    asset.Meta,
+			Variant: variant,
+			Line:    asset.Line,
+			LineNo:  asset.LineNo,
+			Payload: payload,
+			Body:    body,
+			Path:    asset.Source,
+		}:
+		case <-abort:
+			break feed
+		}
+	}
+
+	close(work)
+
+	if notAllowed > 0 || denied > 0 {
+		log.Printf("filtered out %d IMEIs (%d not in %s, %d in %s)", notAllowed+denied, notAllowed, c.opts.AllowFile, denied, c.opts.DenyFile)
+	}
+
+	for result := range results {
+		atomic.StoreInt64(&lastResult, time.Now().UnixNano())
+		switch {
+		case result.Err() != nil:
+			progress.Failure()
+			if c.opts.FailFast {
+				c.triggerAbort(fmt.Errorf("first failure with -fail-fast: %w", result.Err()))
+			}
+		case result.Value()["_already_done"] == true:
+			progress.AlreadyDone()
+		default:
+			progress.Success()
+		}
+		handle(result)
+		for _, sink := range c.opts.Sinks {
+			if err := sink.Write(result); err != nil {
+				log.Printf("result sink: %s", err)
+			}
+		}
+	}
+
+	for _, sink := range c.opts.Sinks {
+		if err := sink.Flush(); err != nil {
+			log.Printf("result sink: %s", err)
+		}
+	}
+
+	if c.opts.EventsFile != "" {
+		progress.emitEvent(c.opts.EventsFile)
+	}
+
+	if c.opts.FailureReport != "" {
+		if err := c.writeFailureReport(c.opts.FailureReport); err != nil {
+			log.Printf("cannot write failure report: %s", err)
+		}
+	}
+
+	// The message stays generic here: the trigger (fail-fast, stall
+	// watchdog, 4xx guard, Ctrl-C) already named itself in the wrapped
+	// error.
+	abortMu.Lock()
+	aborted := abortErr
+	abortMu.Unlock()
+	if aborted != nil {
+		return fmt.Errorf("run aborted: %w", aborted)
+	}
+
+	return nil
+}
+
+// waitForReady polls the health endpoint with a doubling delay until it
+// answers below 300 or the wait window closes.
+func (c *Client) waitForReady() error {
+	path := c.opts.HealthPath
+	if path == "" {
+		path = "/health"
+	}
+	target := c.opts.BaseURL + path
+	deadline := time.Now().Add(c.opts.WaitForReady)
+	delay := time.Second
+
+	for {
+		res, err := c.http.Get(target)
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode < 300 {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("api not ready after %s: %w", c.opts.WaitForReady, err)
+			}
+			return fmt.Errorf("api not ready after %s: %s answered %s", c.opts.WaitForReady, target, res.Status)
+		}
+		log.Printf("waiting for %s to become ready", target)
+		time.Sleep(delay)
+		if delay < 10*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// RefreshToken forces a token refresh, for callers that know the
+// credentials rotated; workers pick the new token up on their next
+// attempt. Refreshes are serialized with the 401-triggered ones.
+func (c *Client) RefreshToken() error {
+	return c.tokens.Refresh()
+}
+
+// Abort winds down a running Run early, as if fail-fast had tripped;
+// in-flight requests are cancelled and the deferred flushes still run.
+func (c *Client) Abort(err error) {
+	if c.triggerAbort != nil {
+		c.triggerAbort(err)
+	}
+}
+
+// warmConnections issues one throwaway HEAD per host before any work is
+// dispatched, so DNS and the TLS handshake are paid up front instead of
+// being charged to the first real requests. Failures are only logged;
+// the run proceeds either way.
+func (c *Client) warmConnections() {
+	targets := map[string]bool{}
+	for _, raw := range []string{c.opts.BaseURL, c.opts.Auth.BaseURL} {
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+		targets[parsed.Scheme+"://"+parsed.Host] = true
+	}
+
+	for target := range targets {
+		req, err := http.NewRequest("HEAD", target, nil)
+		if err != nil {
+			continue
+		}
+		res, err := c.http.Do(req)
+		if err != nil {
+			log.Printf("connection warmup for %s: %s", target, err)
+			continue
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+// captureErrorBody evaluates the -error-body filter for a status: a
+// comma list of exact codes or classes like 5xx. An empty filter
+// captures every body, the previous behavior.
+func captureErrorBody(filter string, status int) bool {
+	if filter == "" {
+		return true
+	}
+	for _, item := range strings.Split(filter, ",") {
+		item = strings.TrimSpace(item)
+		if item == strconv.Itoa(status) {
+			return true
+		}
+		if len(item) == 3 && strings.HasSuffix(item, "xx") && item[0] == byte('0'+status/100) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorSnippet reads the start of an error response body for the log.
+// Some gateways gzip even their error pages, so decompress based on
+// Content-Encoding instead of logging binary garbage.
+func errorSnippet(res *http.Response) string {
+	reader := io.Reader(res.Body)
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return ""
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	snippet, _ := io.ReadAll(io.LimitReader(reader, 256))
+	return strings.TrimSpace(string(snippet))
+}
+
+// HostSummary renders the per-host breakdown collected during Run; it is
+// empty when only one host was involved.
+func (c *Client) HostSummary() string {
+	return c.hosts.Summary()
+}
+
+// validatePayload OPTIONS-posts the payload to the validation endpoint
+// before any real subscribe goes out, catching schema errors while
+// nothing has been mutated yet.
+func (c *Client) validatePayload() error {
+	payload, err := json.Marshal(c.opts.Payload)
+	if err != nil {
+		return fmt.Errorf("encoding payload to json: %w", err)
+	}
+
+	req, err := http.NewRequest("OPTIONS", c.opts.ValidateURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("creating validation request: %w", err)
+	}
+	auth := c.tokens.Current()
+	if c.opts.AuthScheme != "" {
+		auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+	}
+	req.Header.Add("Authorization", auth)
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("validating payload: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode >= 300 {
+		message := fmt.Sprintf("payload failed validation with %s", res.Status)
+		if snippet := errorSnippet(res); snippet != "" {
+			message = fmt.Sprintf("%s: %s", message, snippet)
+		}
+		return errors.New(message)
+	}
+
+	return nil
+}
+
+// Verify re-reads every given IMEI and checks the condition still
+// holds, catching writes that answered 200 without actually persisting.
+// It reports how many IMEIs differ; details go to the log.
+func (c *Client) Verify(imeis []string, condition string) int {
+	mismatches := 0
+	for _, imei := range imeis {
+		state, err := c.fetchState(fmt.Sprintf("%s/services/obdstack/v1/assets/%s/subscribe", c.opts.BaseURL, imei))
+		if err != nil {
+			log.Printf("verify: cannot read state for %s: %s", imei, err)
+			mismatches++
+			continue
+		}
+		if !matchCondition(state, condition) {
+			log.Printf("verify: %s does not match %s", imei, condition)
+			mismatches++
+		}
+	}
+	return mismatches
+}
+
+// fetchState GETs and decodes one resource with the usual auth header.
+func (c *Client) fetchState(target string) (IResult, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth := c.tokens.Current()
+	if c.opts.AuthScheme != "" {
+		auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+	}
+	req.Header.Add("Authorization", auth)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected response %s", res.Status)
+	}
+	return decodeJSON(res.Body)
+}
+
+// precheck GETs the per-IMEI status URL and reports whether the
+// configured condition matches, meaning the subscribe can be skipped.
+func (c *Client) precheck(params IWorkerParams) (bool, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf(c.opts.PrecheckURL, params.Imei), nil)
+	if err != nil {
+		return false, err
+	}
+	auth := c.tokens.Current()
+	if c.opts.AuthScheme != "" {
+		auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+	}
+	req.Header.Add("Authorization", auth)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode != 200 {
+		return false, fmt.Errorf("unexpected precheck response %s", res.Status)
+	}
+
+	result, err := decodeJSON(res.Body)
+	if err != nil {
+		return false, err
+	}
+
+	return matchCondition(result, c.opts.PrecheckWhen), nil
+}
+
+// matchCondition evaluates a "dotted.path=value" condition against a
+// decoded response.
+func matchCondition(result IResult, condition string) bool {
+	parts := strings.SplitN(condition, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var value interface{} = map[string]interface{}(result)
+	for _, key := range strings.Split(parts[0], ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		value = object[key]
+	}
+
+	return fmt.Sprintf("%v", value) == parts[1]
+}
+
+// followPagination keeps requesting the cursor found in the response
+// (or a Link rel="next" header) and aggregates every page until the
+// endpoint is exhausted.
+func (c *Client) followPagination(first IResult, firstRes *http.Response) (IResult, error) {
+	pages := []IResult{first}
+	next := c.nextCursor(first, firstRes)
+
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating pagination request: %w", err)
+		}
+		auth := c.tokens.Current()
+		if c.opts.AuthScheme != "" {
+			auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+		}
+		req.Header.Add("Authorization", auth)
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("following pagination: %w", err)
+		}
+
+		page, err := c.decode(res.Body)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding page: %w", err)
+		}
+
+		pages = append(pages, page)
+		next = c.nextCursor(page, res)
+	}
+
+	if len(pages) == 1 {
+		return first, nil
+	}
+	return IResult{"pages": pages}, nil
+}
+
+// nextCursor pulls the next page URL from the configured cursor field,
+// falling back to a Link rel="next" header.
+func (c *Client) nextCursor(page IResult, res *http.Response) string {
+	if value, ok := page[c.opts.CursorField].(string); ok && value != "" {
+		return value
+	}
+
+	for _, link := range res.Header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			fields := strings.Split(part, ";")
+			if len(fields) < 2 {
+				continue
+			}
+			if strings.TrimSpace(fields[1]) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(fields[0]), "<>")
+			}
+		}
+	}
+
+	return ""
+}
+
+// splitUnixURL turns unix:///run/api.sock into the socket path and a
+// synthetic http base URL; for anything else the URL passes through.
+func splitUnixURL(baseURL string) (socket, rewritten string) {
+	if !strings.HasPrefix(baseURL, "unix://") {
+		return "", baseURL
+	}
+	return strings.TrimPrefix(baseURL, "unix://"), "http://unix"
+}
+
+// buildTLSConfig loads the optional client certificate for endpoints
+// requiring mutual TLS. It returns nil when no certificate is configured.
+func buildTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("provide both a client certificate and its key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// rampDelay slows dispatching during the first RampDuration of the run;
+// the delay shrinks linearly to zero as the window elapses, so the
+// effective rate ramps up instead of bursting at t=0.
+func rampDelay(start time.Time, ramp time.Duration) time.Duration {
+	if ramp <= 0 {
+		return 0
+	}
+	elapsed := time.Since(start)
+	if elapsed >= ramp {
+		return 0
+	}
+	remaining := float64(ramp-elapsed) / float64(ramp)
+	return time.Duration(remaining * float64(100*time.Millisecond))
+}
+
+// recordFailure queues the IMEI for the failed ledger together with a
+// reason column and the source file it came from, so distinct failure
+// modes can be told apart afterwards. Writes happen on the ledger's own
+// goroutine so a slow disk never stalls the workers.
+func (c *Client) recordFailure(params IWorkerParams, reason string) {
+	entry := fmt.Sprintf("%s,%s,%s", params.Imei, reason, params.Path)
+	if c.opts.LedgerLineNumbers && params.LineNo > 0 {
+		entry = fmt.Sprintf("%s,line=%d", entry, params.LineNo)
+	}
+	if params.Meta != "" {
+		entry = fmt.Sprintf("%s,meta=%s", entry, params.Meta)
+	}
+	if params.Variant != "" {
+		entry = fmt.Sprintf("%s,variant=%s", entry, params.Variant)
+	}
+	c.ledger.Record(entry)
+
+	c.failureMu.Lock()
+	defer c.failureMu.Unlock()
+	bucket := c.failures[reason]
+	if bucket == nil {
+		bucket = &IFailureBucket{}
+		c.failures[reason] = bucket
+	}
+	bucket.Count++
+	if len(bucket.Examples) < failureExamples {
+		bucket.Examples = append(bucket.Examples, params.Imei)
+	}
+}
+
+// IFailureBucket is one entry of the failure taxonomy report: how often
+// a failure reason occurred, with a few example IMEIs for triage.
+type IFailureBucket struct {
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+const failureExamples = 5
+
+// writeFailureReport dumps the failure buckets as JSON for incident
+// tooling; an empty run simply writes an empty object.
+func (c *Client) writeFailureReport(path string) error {
+	c.failureMu.Lock()
+	defer c.failureMu.Unlock()
+
+	raw, err := json.MarshalIndent(c.failures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0644)
+}
+
+func (c *Client) doWork(adaptive *IAdaptive, work <-chan IWorkerParams, results chan<- Result, wg *sync.WaitGroup, quit, abort <-chan struct{}) {
+	defer wg.Done()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-abort:
+			return
+		case params, ok := <-work:
+			if !ok {
+				return
+			}
+
+			start := time.Now()
+			result, attempts, err := c.safeRequest(params)
+			adaptive.Observe(time.Since(start), err != nil)
+			c.hosts.Observe(params.Url, time.Since(start), err != nil)
+			c.webhook.Notify(params.Imei, err, result)
+
+			if err != nil {
+				results <- IJsonResult{err: err, attempts: attempts}
+				continue
+			}
+
+			if result == nil {
+				result = IResult{}
+			}
+			if _, ok := result["imei"]; !ok {
+				result["imei"] = params.Imei
+			}
+			if params.Meta != "" {
+				result["_meta"] = params.Meta
+			}
+			if params.Variant != "" {
+				result["_variant"] = params.Variant
+			}
+			results <- IJsonResult{value: result, attempts: attempts}
+		}
+	}
+}
+
+// safeRequest converts a panic inside an attempt into a regular failed
+// result, so one poisoned request neither kills the pool nor loses the
+// entries every other worker has buffered for the ledger.
+func (c *Client) safeRequest(params IWorkerParams) (result IResult, attempts []AttemptInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during request for %s: %v", params.Imei, r)
+			c.recordFailure(params, "panic")
+		}
+	}()
+	return c.doRequest(params)
+}
+
+// doRequest runs up to Retries+1 attempts and records at most one ledger
+// entry, for the final failed attempt.
+func (c *Client) doRequest(params IWorkerParams) (IResult, []AttemptInfo, error) {
+	// A jittered delay desynchronizes the workers, so arrival stays smooth
+	// even when all of them become ready at the same instant.
+	if c.opts.Spread > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(c.opts.Spread))))
+	}
+
+	var result IResult
+	var reason string
+	var retryable bool
+	var retryAfter time.Duration
+	var err error
+
+	// IMEI dedupe happens at load time, but templated payloads can still
+	// produce the same url+body for different input lines; with
+	// DedupeRequests the repeat is skipped instead of sent again.
+	if c.opts.DedupeRequests {
+		if digest, digestErr := c.requestDigest(params); digestErr == nil {
+			c.dedupeMu.Lock()
+			seen := c.dedupeSeen[digest]
+			c.dedupeSeen[digest] = true
+			c.dedupeMu.Unlock()
+			if seen {
+				log.Printf("skipping %s, identical request already sent this run", params.Imei)
+				if err := c.markDone(params); err != nil {
+					return nil, nil, err
+				}
+				return IResult{"imei": params.Imei, "_already_done": true}, nil, nil
+			}
+		}
+	}
+
+	// An optional pre-check GET can tell us the asset is already in the
+	// desired state, in which case the write is skipped entirely.
+	if c.opts.PrecheckURL != "" && c.opts.PrecheckWhen != "" {
+		done, err := c.precheck(params)
+		if err != nil {
+			log.Printf("precheck for %s failed, proceeding anyway: %s", params.Imei, err)
+		} else if done {
+			if err := c.markDone(params); err != nil {
+				return nil, nil, err
+			}
+			return IResult{"imei": params.Imei, "_already_done": true}, nil, nil
+		}
+	}
+
+	var attempts []AttemptInfo
+	for attempt := 1; attempt <= c.opts.Retries+1; attempt++ {
+		start := time.Now()
+		result, reason, retryable, retryAfter, err = c.doAttempt(params, attempt)
+		if c.opts.AttemptHistory {
+			info := AttemptInfo{Reason: reason, Duration: time.Since(start)}
+			if err != nil {
+				info.Error = err.Error()
+			}
+			attempts = append(attempts, info)
+		}
+		if err == nil {
+			c.observe4xx("")
+			return result, attempts, nil
+		}
+		if !retryable {
+			break
+		}
+		// The run-wide budget keeps a flaky API from turning the job into
+		// hours of retries; once spent, every failure is final.
+		if c.opts.RetryBudget > 0 && atomic.AddInt64(&c.retriesSpent, 1) > int64(c.opts.RetryBudget) {
+			c.budgetOnce.Do(func() {
+				log.Printf("retry budget of %d exhausted, not retrying further failures", c.opts.RetryBudget)
+			})
+			break
+		}
+		if attempt <= c.opts.Retries {
+			if delay := c.retryDelay(reason, retryAfter, attempt); delay > 0 {
+				time.Sleep(delay)
+			}
+		}
+	}
+
+	if reason != "" {
+		c.recordFailure(params, reason)
+	}
+	c.observe4xx(reason)
+
+	return nil, attempts, err
+}
+
+// curlCommand renders the assembled request as a copy-pastable curl
+// invocation, for handing a reproduction to the API team. Authorization
+// is redacted unless explicitly asked for.
+func curlCommand(req *http.Request, payload []byte, unsafe bool) string {
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "curl -X %s", req.Method)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			if name == "Authorization" && !unsafe {
+				value = "REDACTED"
+			}
+			fmt.Fprintf(&b, " -H %s", shellQuote(name+": "+value))
+		}
+	}
+	if len(payload) > 0 {
+		fmt.Fprintf(&b, " -d %s", shellQuote(string(payload)))
+	}
+	fmt.Fprintf(&b, " %s", shellQuote(req.URL.String()))
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fdReserve is how many descriptors are left for everything that is not
+// an in-flight request: input files, ledgers, sinks and stdio.
+const fdReserve = 64
+
+// staleConnection recognizes the failure shape of a reused connection
+// the server had already closed: EOF or a broken pipe before any
+// response arrives.
+func staleConnection(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	return strings.Contains(err.Error(), "broken pipe")
+}
+
+// idempotentMethod reports whether a verb can be repeated without
+// changing the outcome, which is what makes that retry safe.
+func idempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// requestDigest hashes the url plus the body the attempt would send,
+// derived the same way doAttempt derives it.
+func (c *Client) requestDigest(params IWorkerParams) (string, error) {
+	var payload []byte
+	if params.Method != "GET" {
+		if params.Body != nil {
+			payload = params.Body
+		} else if c.opts.RawBody != nil {
+			payload = c.opts.RawBody
+		} else {
+			var err error
+			if payload, err = json.Marshal(params.Payload); err != nil {
+				return "", err
+			}
+		}
+	}
+	return c.hash(append([]byte(params.Url+"\n"), payload...)), nil
+}
+
+// retryDelay picks the pause before the next attempt. Rate limiting
+// honors Retry-After and backs off long; server errors retry on a short
+// exponential so transient blips don't stretch the run.
+func (c *Client) retryDelay(reason string, retryAfter time.Duration, attempt int) time.Duration {
+	if reason == "http_429" {
+		if retryAfter > 0 {
+			return retryAfter
+		}
+		return c.opts.Backoff429 << (attempt - 1)
+	}
+	if strings.HasPrefix(reason, "http_5") {
+		return c.opts.Backoff5xx << (attempt - 1)
+	}
+	return 0
+}
+
+// observe4xx feeds the sliding-window 4xx guard: a pervasive share of
+// client errors means the configuration or auth is wrong, and finishing
+// the file would just burn time.
+func (c *Client) observe4xx(reason string) {
+	if c.opts.Abort4xxRatio <= 0 || c.triggerAbort == nil {
+		return
+	}
+	is4xx := strings.HasPrefix(reason, "http_4")
+	if ratio := c.ratio4xx.Observe(is4xx); ratio > c.opts.Abort4xxRatio {
+		c.triggerAbort(fmt.Errorf("%.0f%% of the last %d responses were 4xx, above the %.0f%% threshold", ratio*100, ratioWindow, c.opts.Abort4xxRatio*100))
+	}
+}
+
+const (
+	ratioWindow    = 50
+	ratioMinSample = 20
+)
+
+// IRatioTracker keeps the most recent outcomes in a ring and reports the
+// 4xx fraction once a minimum sample has been seen.
+type IRatioTracker struct {
+	mu     sync.Mutex
+	window [ratioWindow]bool
+	seen   int
+}
+
+func (t *IRatioTracker) Observe(is4xx bool) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.window[t.seen%ratioWindow] = is4xx
+	t.seen++
+	if t.seen < ratioMinSample {
+		return 0
+	}
+
+	sample := t.seen
+	if sample > ratioWindow {
+		sample = ratioWindow
+	}
+	count := 0
+	for i := 0; i < sample; i++ {
+		if t.window[i] {
+			count++
+		}
+	}
+	return float64(count) / float64(sample)
+}
+
+// doAttempt performs a single attempt. Each attempt gets its own context
+// deadline so one slow attempt cannot consume the whole retry budget.
+// The reason return names the failure mode for the ledger; retryable says
+// whether another attempt makes sense.
+func (c *Client) doAttempt(params IWorkerParams, attempt int) (result IResult, reason string, retryable bool, retryAfter time.Duration, err error) {
+	span := c.tracer.StartSpan("subscribe")
+	span.SetAttr("imei", params.Imei)
+	span.SetAttr("attempt", attempt)
+	defer c.tracer.EndSpan(span)
+
+	// GET requests carry no body; everything else sends the payload, or
+	// the raw body file verbatim when one was configured.
+	var payload []byte
+	if params.Method != "GET" {
+		if params.Body != nil {
+			payload = params.Body
+		} else if c.opts.RawBody != nil {
+			payload = c.opts.RawBody
+		} else if payload, err = json.Marshal(params.Payload); err != nil {
+			return nil, "", false, 0, fmt.Errorf("encoding payload to json: %w", err)
+		}
+
+		// Guard against a template or config mistake generating a huge body.
+		if c.opts.MaxBodyBytes > 0 && int64(len(payload)) > c.opts.MaxBodyBytes {
+			return nil, "body_too_large", false, 0, fmt.Errorf("request body is %d bytes, larger than the %d byte limit", len(payload), c.opts.MaxBodyBytes)
+		}
+	}
+
+	req, err := http.NewRequest(params.Method, params.Url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", false, 0, fmt.Errorf("creating new request: %w", err)
+	}
+	// The context covers both the per-attempt deadline and the run-wide
+	// abort channel, so fail-fast and the stall watchdog cancel in-flight
+	// requests instead of waiting them out.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.opts.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.opts.AttemptTimeout)
+		defer cancel()
+	}
+	go func() {
+		select {
+		case <-c.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+	var timings *ITimings
+	if c.opts.TraceTiming {
+		timings = newTimings()
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.trace()))
+	}
+	auth := c.tokens.Current()
+	if c.opts.AuthScheme != "" {
+		auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+	}
+	req.Header.Add("Authorization", auth)
+	contentType := c.opts.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Add("Content-Type", contentType)
+	for name, value := range c.opts.Headers {
+		req.Header.Set(name, value)
+	}
+	if params.ETag != "" {
+		req.Header.Add("If-Match", params.ETag)
+	}
+	if span != nil {
+		req.Header.Add("traceparent", span.Traceparent())
+	}
+
+	// Sign last so the signature covers the finalized body.
+	c.signer.Sign(req, payload)
+
+	if c.opts.PrintCurl {
+		log.Printf("repro: %s", curlCommand(req, payload, c.opts.UnsafeCurl))
+	}
+
+	var res *http.Response
+	if c.cassette.Replaying() {
+		if res = c.cassette.Replay(params.Method, params.Url, payload); res == nil {
+			return nil, "cassette_miss", false, 0, fmt.Errorf("no cassette entry for %s %s", params.Method, params.Url)
+		}
+	} else {
+		res, err = c.http.Do(req)
+		// A keep-alive connection the server closed while idle surfaces as
+		// EOF or a broken pipe on its next use. For idempotent methods one
+		// immediate retry on a fresh connection is safe, independent of
+		// the configured retry policy.
+		if staleConnection(err) && idempotentMethod(params.Method) {
+			retry := req.Clone(req.Context())
+			if req.GetBody != nil {
+				if retry.Body, err = req.GetBody(); err != nil {
+					return nil, "", true, 0, fmt.Errorf("performing request: %w", err)
+				}
+			}
+			log.Printf("stale connection for %s, retrying once on a fresh connection", params.Imei)
+			res, err = c.http.Do(retry)
+		}
+		if err != nil {
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				c.fdLimitOnce.Do(func() {
+					log.Println("hit the OS open-file limit; lower -workers or raise ulimit -n")
+				})
+			}
+			if os.IsTimeout(err) {
+				return nil, "timeout", true, 0, fmt.Errorf("performing request: %w", err)
+			}
+			return nil, "", true, 0, fmt.Errorf("performing request: %w", err)
+		}
+		if c.cassette.Recording() {
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				return nil, "partial_response", true, 0, fmt.Errorf("reading response body: %w", err)
+			}
+			c.cassette.Record(params.Method, params.Url, res.StatusCode, payload, body)
+			res.Body = io.NopCloser(bytes.NewReader(body))
+		}
+	}
+	if timings != nil {
+		log.Printf("timing %s attempt %d: %s", params.Imei, attempt, timings)
+	}
+	// Drain whatever is left so the keep-alive connection can be reused
+	// even when an error path returns before reading the body.
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	span.SetAttr("status", res.StatusCode)
+
+	if res.StatusCode == http.StatusUnauthorized {
+		// The token likely expired mid-run; refresh it so the retry (and
+		// every other worker) picks up a fresh one.
+		if err := c.tokens.Refresh(); err != nil {
+			return nil, "http_401", false, 0, fmt.Errorf("refreshing token: %w", err)
+		}
+		return nil, "http_401", true, 0, fmt.Errorf("unexpected response %s", res.Status)
+	}
+
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return nil, "precondition_failed", false, 0, fmt.Errorf("precondition failed for etag %q", params.ETag)
+	}
+
+	// With redirects disabled a 3xx reaches us directly; for this API that
+	// means a wrong base URL, so surface where it pointed.
+	if res.StatusCode >= 300 && res.StatusCode < 400 {
+		return nil, fmt.Sprintf("http_%d", res.StatusCode), false, 0, fmt.Errorf("unexpected redirect %s to %s", res.Status, res.Header.Get("Location"))
+	}
+
+	// An async endpoint answers 202 with a Location to poll. With polling
+	// enabled the accept is only provisional: follow the Location until a
+	// terminal response or the poll window runs out, and record that final
+	// outcome instead of the fire-and-forget accept.
+	if res.StatusCode == http.StatusAccepted && c.opts.PollTimeout > 0 {
+		if result, err = c.pollAccepted(ctx, res.Header.Get("Location"), params.Imei); err != nil {
+			return nil, "poll_failed", false, 0, err
+		}
+		if err := c.markDone(params); err != nil {
+			return nil, "", false, 0, err
+		}
+		return result, "", false, 0, nil
+	}
+
+	if res.StatusCode != 200 {
+		retryable := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		if res.StatusCode == http.StatusTooManyRequests {
+			if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+		}
+		message := fmt.Sprintf("unexpected response %s", res.Status)
+		// Known-noise statuses (an allowlist of always-404 IMEIs, say) can
+		// be excluded from body capture so the error output stays focused
+		// on the failures that are actionable.
+		if captureErrorBody(c.opts.ErrorBody, res.StatusCode) {
+			if snippet := errorSnippet(res); snippet != "" {
+				message = fmt.Sprintf("%s: %s", message, snippet)
+			}
+		}
+		return nil, fmt.Sprintf("http_%d", res.StatusCode), retryable, retryAfter, errors.New(message)
+	}
+
+	// A truncating proxy otherwise surfaces as a confusing decode error;
+	// comparing the actual body length against Content-Length names the
+	// real problem and makes the attempt retryable.
+	if c.opts.VerifyLength && res.ContentLength >= 0 {
+		body, readErr := io.ReadAll(res.Body)
+		if readErr != nil {
+			return nil, "partial_response", true, 0, fmt.Errorf("reading response body: %w", readErr)
+		}
+		if int64(len(body)) != res.ContentLength {
+			return nil, "length_mismatch", true, 0, fmt.Errorf("response body is %d bytes but Content-Length announced %d", len(body), res.ContentLength)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// A misconfigured endpoint serving a login page with a 200 otherwise
+	// dies at JSON decode with an unhelpful syntax error; checking the
+	// declared type first names the real problem.
+	if c.opts.RequireJSON {
+		if contentType := res.Header.Get("Content-Type"); !strings.Contains(contentType, "json") {
+			return nil, "not_json", false, 0, fmt.Errorf("expected a JSON response, got %q: %s", contentType, errorSnippet(res))
+		}
+	}
+
+	// Decode before touching the source file: a 200 whose body is cut off
+	// mid-stream must not leave the IMEI marked as done.
+	if result, err = c.decode(res.Body); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, "partial_response", true, 0, fmt.Errorf("response body truncated: %w", err)
+		}
+		return nil, "decode_error", false, 0, fmt.Errorf("decoding json response: %w", err)
+	}
+
+	// Follow cursor pagination before anything else so the aggregated
+	// result is what lands in the ledger.
+	if c.opts.Paginate {
+		if result, err = c.followPagination(result, res); err != nil {
+			return nil, "pagination_error", false, 0, err
+		}
+	}
+
+	// Capture requested response headers so callers don't need a second
+	// lookup for values like Location or X-Subscription-Id.
+	if len(c.opts.CaptureHeaders) > 0 {
+		headers := map[string]interface{}{}
+		for _, name := range c.opts.CaptureHeaders {
+			if value := res.Header.Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		if len(headers) > 0 {
+			if result == nil {
+				result = IResult{}
+			}
+			result["_headers"] = headers
+		}
+	}
+
+	if err := c.markDone(params); err != nil {
+		return nil, "", false, 0, err
+	}
+
+	return result, "", false, 0, nil
+}
+
+// pollAccepted follows the Location of a 202 until the operation turns
+// terminal: a 200 is complete, another 202 means keep waiting, anything
+// else fails the poll. The delay between polls doubles up to 30s.
+func (c *Client) pollAccepted(ctx context.Context, location string, imei string) (IResult, error) {
+	if location == "" {
+		return nil, fmt.Errorf("202 response without a Location to poll")
+	}
+
+	deadline := time.Now().Add(c.opts.PollTimeout)
+	delay := c.opts.PollInterval
+	if delay <= 0 {
+		delay = 2 * time.Second
+	}
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+		if err != nil {
+			return nil, err
+		}
+		auth := c.tokens.Current()
+		if c.opts.AuthScheme != "" {
+			auth = fmt.Sprintf("%s %s", c.opts.AuthScheme, auth)
+		}
+		req.Header.Add("Authorization", auth)
+
+		res, err := c.http.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("polling %s: %w", location, err)
+		}
+		if res.StatusCode == http.StatusAccepted {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			continue
+		}
+		if res.StatusCode != 200 {
+			err := fmt.Errorf("poll for %s got %s: %s", imei, res.Status, errorSnippet(res))
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			return nil, err
+		}
+
+		result, err := c.decode(res.Body)
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding poll response: %w", err)
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("operation for %s still pending after %s", imei, c.opts.PollTimeout)
+}
+
+// markDone strikes the processed line from the source file. With
+// KeepInput (offset-based resume on huge inputs) the file is left alone.
+func (c *Client) markDone(params IWorkerParams) error {
+	if c.opts.KeepInput {
+		return nil
+	}
+	if err := removeLine(params.Path, params.Line); err != nil {
+		return fmt.Errorf("removing line from text file: %w", err)
+	}
+	return nil
+}
+
+// loadSet reads a file of IMEIs into a membership set. An empty path
+// yields a nil set, which reads as "no list configured".
+func loadSet(path string) (map[string]bool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	lines, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, line := range lines {
+		if imei := strings.TrimSpace(strings.Split(line, ",")[0]); imei != "" {
+			set[imei] = true
+		}
+	}
+	return set, nil
+}
+
+func readFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	// IMEI exports often arrive gzipped; decompress transparently while
+	// still streaming line by line.
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("opening gzip input %s: %w", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MaxLineLength)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("%s line %d exceeds the %d byte line limit", path, len(lines)+1, MaxLineLength)
+		}
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return lines, nil
+}
+
+func appendToFile(path, content string) {
+	file, err := os.OpenFile(path,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(fmt.Sprintf("%s\n", content)); err != nil {
+		log.Println(err)
+	}
+}
+
+// stripReasons reduces ledger lines back to bare IMEIs so a failed run
+// can be fed straight back in as input.
+func stripReasons(lines []string) []string {
+	var out []string
+	for _, line := range lines {
+		if imei := strings.TrimSpace(strings.Split(line, ",")[0]); imei != "" {
+			out = append(out, imei)
+		}
+	}
+	return out
+}
+
+func writeLines(path string, lines []string) error {
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func removeLine(path, content string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	tmpName := fmt.Sprintf("%s~tmp", path)
+	out, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != content {
+			out.WriteString(fmt.Sprintf("%s\n", line))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.Close()
+	out.Close()
+	err = os.Rename(tmpName, path)
+
+	return err
+}
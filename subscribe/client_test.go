@@ -0,0 +1,325 @@
+package subscribe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The input columns are recognized by shape, so the parser has to hold
+// up across every combination: bare IMEIs, case-insensitive booleans,
+// bare-number priorities, quoted ETags, metadata and stray whitespace.
+func TestParseAssets(t *testing.T) {
+	reboot := func(value bool) *bool { return &value }
+
+	cases := []struct {
+		line     string
+		expected Asset
+	}{
+		{"350000000000001", Asset{Imei: "350000000000001"}},
+		{"350000000000002,true", Asset{Imei: "350000000000002", Reboot: reboot(true)}},
+		{"350000000000003,FALSE", Asset{Imei: "350000000000003", Reboot: reboot(false)}},
+		{"350000000000004,5", Asset{Imei: "350000000000004", Priority: 5}},
+		{`350000000000005,"v7"`, Asset{Imei: "350000000000005", ETag: `"v7"`}},
+		{`350000000000006,"v7",5,fleet-west`, Asset{Imei: "350000000000006", ETag: `"v7"`, Priority: 5, Meta: "fleet-west"}},
+		{" 350000000000007 , true , 3 ", Asset{Imei: "350000000000007", Reboot: reboot(true), Priority: 3}},
+		{"350000000000008,fleet-east", Asset{Imei: "350000000000008", ETag: "fleet-east"}},
+		// Only the first bare number is a priority; a second one falls
+		// back to the positional meaning.
+		{"350000000000009,5,7", Asset{Imei: "350000000000009", Priority: 5, ETag: "7"}},
+	}
+
+	for i, c := range cases {
+		assets := ParseAssets([]string{c.line})
+		if len(assets) != 1 {
+			t.Fatalf("%q parsed into %d assets", c.line, len(assets))
+		}
+		got := assets[0]
+		c.expected.Line = c.line
+		c.expected.LineNo = 1
+
+		if got.Imei != c.expected.Imei || got.ETag != c.expected.ETag ||
+			got.Priority != c.expected.Priority || got.Meta != c.expected.Meta ||
+			got.Line != c.expected.Line || got.LineNo != c.expected.LineNo {
+			t.Errorf("case %d %q: got %+v, expected %+v", i, c.line, got, c.expected)
+		}
+		switch {
+		case (got.Reboot == nil) != (c.expected.Reboot == nil):
+			t.Errorf("case %d %q: reboot presence mismatch", i, c.line)
+		case got.Reboot != nil && *got.Reboot != *c.expected.Reboot:
+			t.Errorf("case %d %q: reboot = %v, expected %v", i, c.line, *got.Reboot, *c.expected.Reboot)
+		}
+	}
+}
+
+// testOptions wires a Client to the given test server: the caller-supplied
+// token skips the oauth round trip and the failed ledger lands in dir.
+func testOptions(baseURL, dir string) Options {
+	return Options{
+		Workers:      1,
+		Token:        "test-token",
+		BaseURL:      baseURL,
+		FailedLedger: filepath.Join(dir, "failed.txt"),
+	}
+}
+
+// writeInput writes one line per asset into dir and returns the parsed
+// assets tagged with their source file, mirroring what LoadAssets does.
+func writeInput(t *testing.T, dir string, lines []string) (string, []Asset) {
+	t.Helper()
+	path := filepath.Join(dir, "input.txt")
+	if err := writeLines(path, lines); err != nil {
+		t.Fatal(err)
+	}
+	assets := ParseAssets(lines)
+	for i := range assets {
+		assets[i].Source = path
+	}
+	return path, assets
+}
+
+// A 200 whose body does not decode must not count as done: the IMEI has
+// to survive in the source file and land in the failed ledger, otherwise
+// a resume would silently skip it.
+func TestDecodeErrorKeepsLine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>not json</html>"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	input, assets := writeInput(t, dir, []string{"350000000000001"})
+	client, err := New(testOptions(server.URL, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed error
+	if err := client.Run(assets, func(result Result) {
+		if result.Err() != nil {
+			failed = result.Err()
+		}
+	}); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if failed == nil {
+		t.Fatal("expected the decode failure to surface as a result error")
+	}
+
+	lines, err := readFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != "350000000000001" {
+		t.Fatalf("input file should still hold the IMEI, got %v", lines)
+	}
+
+	ledger, err := readFile(filepath.Join(dir, "failed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ledger) != 1 || !strings.HasPrefix(ledger[0], "350000000000001,decode_error,") {
+		t.Fatalf("expected a decode_error ledger entry, got %v", ledger)
+	}
+}
+
+// Error responses must still be drained and closed: a leaked body pins
+// its connection's read/write goroutine pair instead of letting the
+// connection be reused, so after many erroring requests the goroutine
+// count has to settle back to the baseline.
+func TestNoConnectionLeakOnErrorResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such asset", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("3500000000000%02d", i))
+	}
+	_, assets := writeInput(t, dir, lines)
+
+	opts := testOptions(server.URL, dir)
+	opts.Workers = 4
+	client, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	if err := client.Run(assets, func(Result) {}); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+
+	// Idle keep-alive connections legitimately hold goroutines; drop
+	// them, then anything still above the baseline is a leak.
+	transport, _ := client.http.Transport.(*http.Transport)
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport.CloseIdleConnections()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine()-before > 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines leaked after %d erroring requests", runtime.NumGoroutine()-before, len(assets))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// A run cancelled in flight must still flush the buffered ledger before
+// Run returns: the partial failure record is exactly what the next
+// -only-failed run works from.
+func TestAbortMidRunFlushesLedger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf("35000000000000%02d", i))
+	}
+	_, assets := writeInput(t, dir, lines)
+
+	opts := testOptions(server.URL, dir)
+	opts.Workers = 2
+	client, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := 0
+	err = client.Run(assets, func(Result) {
+		results++
+		if results == 3 {
+			client.Abort(fmt.Errorf("cancelled by the test"))
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "run aborted") {
+		t.Fatalf("expected an aborted-run error, got %v", err)
+	}
+
+	ledger, err := readFile(filepath.Join(dir, "failed.txt"))
+	if err != nil {
+		t.Fatalf("ledger was not flushed: %s", err)
+	}
+	if len(ledger) == 0 {
+		t.Fatal("expected the failures seen before the abort in the ledger")
+	}
+	for _, entry := range ledger {
+		if !strings.Contains(entry, ",http_500,") {
+			t.Fatalf("unexpected ledger entry %q", entry)
+		}
+	}
+}
+
+// clientCertFiles generates a self-signed certificate usable for client
+// auth, writes the PEM pair into dir and returns the paths plus the
+// parsed certificate so the test server can trust it as a CA.
+func clientCertFiles(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "subscribe-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "client.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile = filepath.Join(dir, "client.key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+// A server requiring mutual TLS must see the -client-cert certificate on
+// the subscribe request; without it the handshake would fail before the
+// handler runs.
+func TestClientCertificatePresented(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := clientCertFiles(t, dir)
+
+	sawCert := false
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawCert = r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	_, assets := writeInput(t, dir, []string{"350000000000001"})
+	opts := testOptions(server.URL, dir)
+	opts.ClientCert = certFile
+	opts.ClientKey = keyFile
+	client, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client additionally has to trust the test server's self-signed
+	// certificate; outside of tests that trust comes from the system roots.
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client.http.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+	var failed error
+	if err := client.Run(assets, func(result Result) {
+		if result.Err() != nil {
+			failed = result.Err()
+		}
+	}); err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if failed != nil {
+		t.Fatalf("request against the client-auth server failed: %s", failed)
+	}
+	if !sawCert {
+		t.Fatal("server did not see a client certificate")
+	}
+}
@@ -0,0 +1,109 @@
+package subscribe
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// IDecoder turns a response body into the IResult handed to the results
+// channel. Decoding is decoupled from the request logic so new formats
+// only need a new entry in newDecoder.
+type IDecoder func(io.Reader) (IResult, error)
+
+func newDecoder(format string, floatNumbers bool) (IDecoder, error) {
+	switch format {
+	case "json":
+		if floatNumbers {
+			return decodeJSONFloat, nil
+		}
+		return decodeJSON, nil
+	case "ndjson":
+		return decodeStream, nil
+	case "xml":
+		return decodeXML, nil
+	case "text":
+		return decodeText, nil
+	case "none":
+		return decodeNone, nil
+	default:
+		return nil, fmt.Errorf("unsupported -response-format %q", format)
+	}
+}
+
+// decodeJSON keeps numbers as their exact literals (json.Number): a
+// 64-bit subscription id decoded into float64 silently turns into
+// 1.23e+18 by the time it reaches the ledger.
+func decodeJSON(r io.Reader) (IResult, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var result IResult
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeJSONFloat is the old float64 behavior, kept behind a flag for
+// consumers that do arithmetic on the decoded values.
+func decodeJSONFloat(r io.Reader) (IResult, error) {
+	var result IResult
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodeStream consumes a stream of JSON objects, as bulk endpoints
+// emit progressively, and aggregates them instead of expecting a single
+// object. NDJSON and concatenated JSON both decode.
+func decodeStream(r io.Reader) (IResult, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var items []interface{}
+	for {
+		var item interface{}
+		if err := decoder.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return IResult{"items": items, "count": len(items)}, nil
+}
+
+// decodeXML keeps the raw document but walks it first so malformed or
+// truncated XML is still reported as a decode failure.
+func decodeXML(r io.Reader) (IResult, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return IResult{"xml": string(raw)}, nil
+}
+
+func decodeText(r io.Reader) (IResult, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return IResult{"text": string(raw)}, nil
+}
+
+// decodeNone discards the body; only the status mattered.
+func decodeNone(io.Reader) (IResult, error) {
+	return IResult{}, nil
+}
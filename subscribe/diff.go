@@ -0,0 +1,36 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// loadStateFile reads a JSON object mapping each IMEI to its field
+// values, the shape both the desired-state and prior-state files share.
+func loadStateFile(path string) (map[string]map[string]interface{}, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state map[string]map[string]interface{}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("decoding state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// diffFields returns the desired fields whose value differs from the
+// prior state, so an update carries only what actually changed and
+// leaves every other field untouched.
+func diffFields(desired, prior map[string]interface{}) map[string]interface{} {
+	changed := map[string]interface{}{}
+	for field, value := range desired {
+		if prev, ok := prior[field]; !ok || !reflect.DeepEqual(prev, value) {
+			changed[field] = value
+		}
+	}
+	return changed
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package subscribe
+
+import "syscall"
+
+// openFileLimit reports the soft file-descriptor limit, or 0 when it
+// cannot be read.
+func openFileLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return uint64(limit.Cur)
+}
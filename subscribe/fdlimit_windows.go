@@ -0,0 +1,8 @@
+//go:build windows
+
+package subscribe
+
+// openFileLimit has no equivalent on Windows; 0 disables the clamp.
+func openFileLimit() uint64 {
+	return 0
+}
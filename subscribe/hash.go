@@ -0,0 +1,36 @@
+package subscribe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+)
+
+// IHasher produces the digests run-scoped features such as request
+// dedupe key on. The default fnv is fast and spreads well; sha256 is
+// the choice when a digest must stay stable across versions and resist
+// collisions, which is why the cassette keys use it unconditionally.
+type IHasher func([]byte) string
+
+func newHasher(algo string) (IHasher, error) {
+	switch algo {
+	case "", "fnv":
+		return digestFNV, nil
+	case "sha256":
+		return digestSHA256, nil
+	default:
+		return nil, fmt.Errorf("unsupported -hash %q, expected fnv or sha256", algo)
+	}
+}
+
+func digestSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func digestFNV(data []byte) string {
+	h := fnv.New64a()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
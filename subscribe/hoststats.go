@@ -0,0 +1,78 @@
+package subscribe
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IHostStats aggregates outcomes and latency for one host, so a degraded
+// regional endpoint stands out when several base URLs are in play.
+type IHostStats struct {
+	Succeeded int
+	Failed    int
+	Latency   time.Duration
+}
+
+type IHostTracker struct {
+	mu    sync.Mutex
+	stats map[string]*IHostStats
+}
+
+func newHostTracker() *IHostTracker {
+	return &IHostTracker{stats: map[string]*IHostStats{}}
+}
+
+func (t *IHostTracker) Observe(rawURL string, latency time.Duration, failed bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.stats[parsed.Host]
+	if stats == nil {
+		stats = &IHostStats{}
+		t.stats[parsed.Host] = stats
+	}
+	if failed {
+		stats.Failed++
+	} else {
+		stats.Succeeded++
+	}
+	stats.Latency += latency
+}
+
+// Summary renders a per-host table, or nothing when only one host was
+// involved and the overall summary already tells the story.
+func (t *IHostTracker) Summary() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.stats) < 2 {
+		return ""
+	}
+
+	var hosts []string
+	for host := range t.stats {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var b strings.Builder
+	for _, host := range hosts {
+		stats := t.stats[host]
+		total := stats.Succeeded + stats.Failed
+		avg := time.Duration(0)
+		if total > 0 {
+			avg = stats.Latency / time.Duration(total)
+		}
+		fmt.Fprintf(&b, "%s: %d succeeded, %d failed, avg %s\n", host, stats.Succeeded, stats.Failed, avg.Round(time.Millisecond))
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package subscribe
+
+import "sync"
+
+// ILedger serializes failed-ledger appends through a single goroutine
+// with a bounded buffer, so workers stay productive while the file is
+// slow without memory growing with the backlog.
+type ILedger struct {
+	path    string
+	entries chan string
+	pending sync.WaitGroup
+}
+
+func newLedger(path string) *ILedger {
+	ledger := &ILedger{
+		path:    path,
+		entries: make(chan string, 256),
+	}
+	go func() {
+		for entry := range ledger.entries {
+			appendToFile(ledger.path, entry)
+			ledger.pending.Done()
+		}
+	}()
+	return ledger
+}
+
+// Record queues one ledger line. When the buffer is full this blocks,
+// which bounds memory instead of dropping entries.
+func (l *ILedger) Record(entry string) {
+	l.pending.Add(1)
+	l.entries <- entry
+}
+
+// Flush waits until every queued entry has been written.
+func (l *ILedger) Flush() {
+	l.pending.Wait()
+}
@@ -0,0 +1,51 @@
+package subscribe
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Producers outrunning the single writer is the normal case under load:
+// the buffer bounds memory by blocking Record, and Flush must still see
+// every entry on disk without the two sides deadlocking.
+func TestSlowConsumerDoesNotDeadlock(t *testing.T) {
+	const producers, perProducer = 8, 200 // several times the channel buffer
+
+	path := filepath.Join(t.TempDir(), "failed.txt")
+	ledger := newLedger(path)
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				ledger.Record(fmt.Sprintf("35000000000%02d%03d,http_500,input.txt", p, i))
+			}
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		ledger.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ledger deadlocked with a slow consumer")
+	}
+
+	lines, err := readFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != producers*perProducer {
+		t.Fatalf("ledger holds %d entries, expected %d", len(lines), producers*perProducer)
+	}
+}
@@ -0,0 +1,137 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is how many seconds the live rate looks back; long enough
+// to smooth jitter, short enough to show throttling as it happens.
+const rateWindow = 10
+
+type IProgress struct {
+	total       int64
+	succeeded   int64
+	failed      int64
+	alreadyDone int64
+	start       time.Time
+
+	windowMu sync.Mutex
+	buckets  [rateWindow]int64
+	bucketAt [rateWindow]int64
+}
+
+func newProgress(total int) *IProgress {
+	return &IProgress{total: int64(total), start: time.Now()}
+}
+
+func (p *IProgress) Success() {
+	atomic.AddInt64(&p.succeeded, 1)
+	p.markDone()
+}
+
+func (p *IProgress) Failure() {
+	atomic.AddInt64(&p.failed, 1)
+	p.markDone()
+}
+
+func (p *IProgress) AlreadyDone() {
+	atomic.AddInt64(&p.alreadyDone, 1)
+	p.markDone()
+}
+
+// markDone counts the completion into a per-second ring bucket so the
+// live rate reflects the recent window, not the whole run.
+func (p *IProgress) markDone() {
+	now := time.Now().Unix()
+	slot := now % rateWindow
+
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	if p.bucketAt[slot] != now {
+		p.bucketAt[slot] = now
+		p.buckets[slot] = 0
+	}
+	p.buckets[slot]++
+}
+
+// liveRate averages the completions of the last rateWindow seconds.
+func (p *IProgress) liveRate() float64 {
+	now := time.Now().Unix()
+
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+
+	var count int64
+	for slot := 0; slot < rateWindow; slot++ {
+		if now-p.bucketAt[slot] < rateWindow {
+			count += p.buckets[slot]
+		}
+	}
+
+	window := time.Since(p.start).Seconds()
+	if window > rateWindow {
+		window = rateWindow
+	}
+	if window <= 0 {
+		return 0
+	}
+	return float64(count) / window
+}
+
+type IProgressEvent struct {
+	Time        string  `json:"time"`
+	Total       int64   `json:"total"`
+	Succeeded   int64   `json:"succeeded"`
+	Failed      int64   `json:"failed"`
+	AlreadyDone int64   `json:"already_done"`
+	Rate        float64 `json:"rate"`
+	LiveRate    float64 `json:"live_rate"`
+}
+
+func (p *IProgress) snapshot() IProgressEvent {
+	succeeded := atomic.LoadInt64(&p.succeeded)
+	failed := atomic.LoadInt64(&p.failed)
+
+	rate := 0.0
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		rate = float64(succeeded+failed) / elapsed
+	}
+
+	return IProgressEvent{
+		Time:        time.Now().Format(time.RFC3339),
+		Total:       p.total,
+		Succeeded:   succeeded,
+		Failed:      failed,
+		AlreadyDone: atomic.LoadInt64(&p.alreadyDone),
+		Rate:        rate,
+		LiveRate:    p.liveRate(),
+	}
+}
+
+func (p *IProgress) emitEvent(path string) {
+	event, err := json.Marshal(p.snapshot())
+	if err != nil {
+		return
+	}
+	appendToFile(path, string(event))
+}
+
+// emitEvents appends an NDJSON snapshot to the events file every second
+// until stop is closed; the caller writes the final snapshot. The events
+// stream is separate from the results output so a dashboard can tail it.
+func emitEvents(path string, p *IProgress, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.emitEvent(path)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package subscribe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ResultSink receives every result produced by Run. Write is called from
+// the results loop in order; Flush runs once at the end of the run.
+// Programs embedding the library can plug their own implementation via
+// Options.Sinks.
+type ResultSink interface {
+	Write(Result) error
+	Flush() error
+}
+
+// ISinkRecord is the JSON shape the file sink writes per result.
+type ISinkRecord struct {
+	Error    string        `json:"error,omitempty"`
+	Value    IResult       `json:"value,omitempty"`
+	Attempts []AttemptInfo `json:"attempts,omitempty"`
+}
+
+// IFileSink appends each result as one JSON line to a file.
+type IFileSink struct {
+	file *os.File
+}
+
+func NewFileSink(path string) (*IFileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening results file: %w", err)
+	}
+	return &IFileSink{file: file}, nil
+}
+
+func (s *IFileSink) Write(result Result) error {
+	record := ISinkRecord{Value: result.Value(), Attempts: result.Attempts()}
+	if result.Err() != nil {
+		record.Error = result.Err().Error()
+	}
+
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(raw, '\n'))
+	return err
+}
+
+func (s *IFileSink) Flush() error {
+	return s.file.Close()
+}
+
+// Write adapts the webhook to the ResultSink interface for library
+// consumers; the CLI keeps notifying it per worker where the IMEI is
+// still at hand.
+func (w *IWebhook) Write(result Result) error {
+	imei, _ := result.Value()["imei"].(string)
+	w.Notify(imei, result.Err(), result.Value())
+	return nil
+}
+
+func (w *IWebhook) Flush() error {
+	return nil
+}
+
+// NewWebhookSink exposes the webhook as a standalone ResultSink.
+func NewWebhookSink(url string, client *http.Client) ResultSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return newWebhook(url, client)
+}
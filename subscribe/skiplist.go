@@ -0,0 +1,71 @@
+package subscribe
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ISkipList is a set of IMEIs re-read from a watched file, so specific
+// IMEIs can be pulled out of the queue while a run is in flight.
+type ISkipList struct {
+	path  string
+	mu    sync.RWMutex
+	imeis map[string]bool
+}
+
+// newSkipList returns nil when path is empty; Has is nil-safe so the
+// feeder can check it unconditionally. The file is re-read by polling
+// every couple of seconds until stop is closed.
+func newSkipList(path string, stop <-chan struct{}) *ISkipList {
+	if path == "" {
+		return nil
+	}
+
+	s := &ISkipList{path: path, imeis: map[string]bool{}}
+	s.reload()
+
+	go func() {
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.reload()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *ISkipList) reload() {
+	lines, err := readFile(s.path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	imeis := map[string]bool{}
+	for _, line := range lines {
+		if imei := strings.TrimSpace(strings.Split(line, ",")[0]); imei != "" {
+			imeis[imei] = true
+		}
+	}
+
+	s.mu.Lock()
+	s.imeis = imeis
+	s.mu.Unlock()
+}
+
+func (s *ISkipList) Has(imei string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.imeis[imei]
+}
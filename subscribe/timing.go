@@ -0,0 +1,62 @@
+package subscribe
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"time"
+)
+
+// ITimings collects the phase durations of one attempt via httptrace, so
+// slowness can be attributed to DNS, connect, TLS handshake or the server.
+type ITimings struct {
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	ttfb         time.Duration
+	reused       bool
+}
+
+func newTimings() *ITimings {
+	return &ITimings{start: time.Now()}
+}
+
+// trace wires the collection hooks into a ClientTrace. On a reused
+// keep-alive connection only TTFB is populated and reused is set.
+func (t *ITimings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.dns = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.tls = time.Since(t.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			t.ttfb = time.Since(t.start)
+		},
+	}
+}
+
+func (t *ITimings) String() string {
+	return fmt.Sprintf("dns=%s connect=%s tls=%s ttfb=%s reused=%t",
+		t.dns, t.connect, t.tls, t.ttfb, t.reused)
+}
@@ -0,0 +1,85 @@
+package subscribe
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// IWebhookEvent is the JSON body POSTed to the webhook for each result.
+type IWebhookEvent struct {
+	Imei    string  `json:"imei"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+	Outcome IResult `json:"outcome,omitempty"`
+}
+
+// IWebhook pushes per-result events to an HTTP endpoint so downstream
+// systems can react while the run is still going. It retries on its own,
+// independently of the main request's retry loop.
+type IWebhook struct {
+	client *http.Client
+	url    string
+}
+
+func newWebhook(url string, client *http.Client) *IWebhook {
+	if url == "" {
+		return nil
+	}
+	return &IWebhook{client: client, url: url}
+}
+
+const webhookRetries = 3
+
+// Notify delivers one event, retrying with a short backoff. Failures are
+// logged and dropped; the webhook must never fail the run itself.
+func (w *IWebhook) Notify(imei string, runErr error, outcome IResult) {
+	if w == nil {
+		return
+	}
+
+	event := IWebhookEvent{Imei: imei, Status: "success", Outcome: outcome}
+	if runErr != nil {
+		event.Status = "failed"
+		event.Error = runErr.Error()
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("cannot encode webhook event for %s: %s", imei, err)
+		return
+	}
+
+	for attempt := 1; attempt <= webhookRetries; attempt++ {
+		if w.deliver(payload) == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+	}
+	log.Printf("webhook delivery for %s failed after %d attempts", imei, webhookRetries)
+}
+
+func (w *IWebhook) deliver(payload []byte) error {
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	if res.StatusCode >= 300 {
+		return errUnexpectedStatus(res.Status)
+	}
+	return nil
+}
+
+type errUnexpectedStatus string
+
+func (e errUnexpectedStatus) Error() string {
+	return "unexpected webhook response " + string(e)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/subscribe/subscribe"
+)
+
+const tuiRecentFailures = 5
+
+// ITui redraws a small status block in place while the run is going:
+// counts, rate, the most recent failures and the per-host table. The
+// ledgers and logs stay authoritative; this is purely for an operator
+// babysitting a long run.
+type ITui struct {
+	client *subscribe.Client
+	total  int
+	start  time.Time
+	stop   chan struct{}
+	done   chan struct{}
+	lines  int
+
+	mu        sync.Mutex
+	succeeded int
+	failed    int
+	recent    []string
+}
+
+// newTui returns nil when stdout is not a terminal, and every method on
+// a nil ITui is a no-op, so callers fall back to plain logging without
+// branching.
+func newTui(total int, client *subscribe.Client) *ITui {
+	info, err := os.Stdout.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+
+	t := &ITui{client: client, total: total, start: time.Now(), stop: make(chan struct{}), done: make(chan struct{})}
+	go t.loop()
+	return t
+}
+
+func (t *ITui) Observe(result subscribe.Result) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if result.Err() != nil {
+		t.failed++
+		t.recent = append(t.recent, result.Err().Error())
+		if len(t.recent) > tuiRecentFailures {
+			t.recent = t.recent[1:]
+		}
+		return
+	}
+	t.succeeded++
+}
+
+func (t *ITui) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.redraw()
+		}
+	}
+}
+
+// redraw repaints the status block over its previous rendering by
+// moving the cursor up and clearing each line before rewriting it.
+func (t *ITui) redraw() {
+	t.mu.Lock()
+	done := t.succeeded + t.failed
+	rate := 0.0
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+		rate = float64(done) / elapsed
+	}
+	lines := []string{fmt.Sprintf("%d/%d done, %d failed, %.1f req/s, elapsed %s",
+		done, t.total, t.failed, rate, time.Since(t.start).Round(time.Second))}
+	for _, failure := range t.recent {
+		lines = append(lines, "  "+failure)
+	}
+	t.mu.Unlock()
+
+	if table := t.client.HostSummary(); table != "" {
+		lines = append(lines, strings.Split(strings.TrimRight(table, "\n"), "\n")...)
+	}
+
+	var b strings.Builder
+	if t.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", t.lines)
+	}
+	for _, line := range lines {
+		b.WriteString("\033[K" + line + "\n")
+	}
+	t.lines = len(lines)
+	fmt.Print(b.String())
+}
+
+// Close stops the redraw loop, leaving the final state on screen.
+func (t *ITui) Close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.redraw()
+}